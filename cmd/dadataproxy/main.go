@@ -2,22 +2,32 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"github.com/ilazutin/dadataproxy_go/internal/api/helper"
 	server "github.com/ilazutin/dadataproxy_go/internal/api/rest_server"
 	"github.com/ilazutin/dadataproxy_go/internal/config"
 	"github.com/ilazutin/dadataproxy_go/internal/service"
 	"github.com/ilazutin/dadataproxy_go/internal/service/dadata"
-	storage "github.com/ilazutin/dadataproxy_go/internal/storage/redis"
+	"github.com/ilazutin/dadataproxy_go/internal/storage"
+	"github.com/ilazutin/dadataproxy_go/internal/storage/memory"
+	"github.com/ilazutin/dadataproxy_go/internal/storage/redis"
+	"github.com/ilazutin/dadataproxy_go/internal/storage/tiered"
 )
 
 const (
 	envLocal = "local"
 	envProd  = "prod"
+
+	storageRedis  = "redis"
+	storageMemory = "memory"
+	storageTiered = "tiered"
 )
 
 func main() {
@@ -26,28 +36,86 @@ func main() {
 	log := setupLogger(cfg.Env)
 	log.Info("Starting dadata proxy", slog.String("env", cfg.Env))
 
-	redis := storage.New(context.Background(), cfg.Redis.Url, cfg.Redis.Password, log, cfg.Redis.Expire)
+	cache := setupStorage(cfg, log)
+
+	dadata, err := dadata.New(cfg.DaData, nil, log)
+	if err != nil {
+		log.Error("Couldn't create dadata client", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
 
-	dadata := dadata.New(cfg.DaData.Token, cfg.DaData.SecretKey)
+	proxy := service.New(dadata, cache, cfg.Cache, log)
 
-	proxy := service.New(dadata, redis, log)
+	trustedProxies, err := helper.ParseTrustedProxies(cfg.HTTPServer.TrustedProxies)
+	if err != nil {
+		log.Error("Couldn't parse trusted proxies", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
 
-	server := server.New(cfg.HTTPServer.Address, cfg.HTTPServer.Timeout, cfg.HTTPServer.IdleTimeout, proxy, log)
+	server := server.New(cfg.HTTPServer.Address, cfg.HTTPServer.Timeout, cfg.HTTPServer.IdleTimeout, trustedProxies, cfg.Passthrough.Routes, proxy, log)
 
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 	defer signal.Stop(done)
 
-	err := server.Run(context.Background())
-	if err != nil {
-		log.Error("Couldn't run server", slog.String("error", err.Error()))
-	}
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	go func() {
+		if err := proxy.ResumeJobs(ctx, log); err != nil {
+			log.Error("Couldn't resume jobs", slog.String("error", err.Error()))
+		}
+
+		if cfg.Cache.MigrateOnStartup {
+			_, err := proxy.StartMigrationsJob(ctx, false, log)
+			switch {
+			case errors.Is(err, service.ErrMigrationsRunning):
+				log.Info("Migrations are already running", slog.String("reason", err.Error()))
+			case err != nil:
+				log.Error("Couldn't start migrations", slog.String("error", err.Error()))
+			}
+		}
+	}()
+
+	go func() {
+		err := server.Run(ctx)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error("Couldn't run server", slog.String("error", err.Error()))
+			done <- syscall.SIGTERM
+		}
+	}()
 
 	<-done
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	server.Shutdown(ctx.Err())
+	server.Shutdown(shutdownCtx)
+	stop()
+}
+
+func setupStorage(cfg *config.Config, log *slog.Logger) storage.Storage {
+	switch cfg.Storage.Type {
+	case storageMemory:
+		log.Info("Using in-memory storage", slog.Int("size", cfg.Storage.Memory.Size))
+		return memory.New(cfg.Storage.Memory.Size, cfg.Redis.Expire, log)
+	case storageRedis:
+		log.Info("Using redis storage", slog.String("url", cfg.Redis.Url))
+		return redis.New(cfg.Redis.Url, cfg.Redis.Password, log, cfg.Redis.Expire)
+	case storageTiered:
+		log.Info("Using tiered storage",
+			slog.Int("l1_size", cfg.Storage.Tiered.Size),
+			slog.String("l1_expire", cfg.Storage.Tiered.Expire.String()),
+			slog.String("l2_url", cfg.Redis.Url),
+		)
+		l1 := memory.New(cfg.Storage.Tiered.Size, cfg.Storage.Tiered.Expire, log)
+		l2 := redis.New(cfg.Redis.Url, cfg.Redis.Password, log, cfg.Redis.Expire)
+		return tiered.New(l1, l2, cfg.Storage.Tiered.Expire, service.ControlKeyPrefixes(cfg.Cache), log)
+	default:
+		log.Error("Unknown storage type", slog.String("type", cfg.Storage.Type))
+		os.Exit(1)
+	}
+
+	return nil
 }
 
 func setupLogger(env string) *slog.Logger {
@@ -1,12 +1,31 @@
 package helper
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/ilazutin/dadataproxy_go/internal/service"
+	"github.com/ilazutin/dadataproxy_go/internal/service/dadata"
+)
+
+const (
+	HeaderCacheStale  = "X-Cache-Stale"
+	HeaderBatchFailed = "X-Batch-Failed"
+
+	ParamIgnoreCache = "ignore_cache"
 )
 
 type ErrorResponse struct {
-	Errors []string `json:"errors"`
+	Errors         []string `json:"errors"`
+	Code           string   `json:"code,omitempty"`
+	UpstreamStatus int      `json:"upstream_status,omitempty"`
+	UpstreamBody   string   `json:"upstream_body,omitempty"`
 }
 
 func ResponseErrors(w http.ResponseWriter, err error) {
@@ -27,6 +46,34 @@ func ResponseInternalError(w http.ResponseWriter, err error) {
 	json.NewEncoder(w).Encode(ErrorResponse{Errors: messages}) //nolint:errcheck,errchkjson
 }
 
+func ResponseUpstreamError(w http.ResponseWriter, err error) {
+	var dadataErr *dadata.Error
+	if !errors.As(err, &dadataErr) {
+		ResponseInternalError(w, err)
+		return
+	}
+
+	status := http.StatusBadGateway
+	switch {
+	case errors.Is(err, dadata.ErrQuotaExceeded), errors.Is(err, dadata.ErrRateLimited):
+		status = http.StatusTooManyRequests
+	case errors.Is(err, dadata.ErrCircuitOpen):
+		status = http.StatusServiceUnavailable
+	case errors.Is(err, dadata.ErrBadRequest), errors.Is(err, dadata.ErrUnauthorized), errors.Is(err, dadata.ErrForbidden):
+		status = dadataErr.StatusCode
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	json.NewEncoder(w).Encode(ErrorResponse{ //nolint:errcheck,errchkjson
+		Errors:         []string{err.Error()},
+		Code:           dadataErr.Code(),
+		UpstreamStatus: dadataErr.StatusCode,
+		UpstreamBody:   dadataErr.Body,
+	})
+}
+
 func ResponseOk(w http.ResponseWriter, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -38,6 +85,15 @@ func ResponseOk(w http.ResponseWriter, data interface{}) {
 	}
 }
 
+func ResponseAccepted(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		ResponseErrors(w, err)
+	}
+}
+
 func ResponseNoContent(w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusNoContent)
@@ -51,3 +107,79 @@ func ResponseNotFound(w http.ResponseWriter, data interface{}) {
 		ResponseErrors(w, err)
 	}
 }
+
+// RequestContext returns the context of r naming the route pattern that
+// served it as the usage endpoint.
+func RequestContext(r *http.Request) context.Context {
+	ctx := r.Context()
+	if routeContext := chi.RouteContext(ctx); routeContext != nil {
+		return service.WithEndpoint(ctx, routeContext.RoutePattern())
+	}
+
+	return ctx
+}
+
+// ReadQuery returns the DaData query of the request: the body of a POST,
+// or the query string parameters of a GET encoded as a JSON object.
+func ReadQuery(r *http.Request) ([]byte, error) {
+	if r.Method != http.MethodGet {
+		return io.ReadAll(r.Body)
+	}
+
+	return QueryToJSON(r.URL.Query(), ParamIgnoreCache)
+}
+
+// numericParams are DaData parameters sent as JSON numbers; every other
+// parameter stays a string, so an INN or a house number is not mangled.
+var numericParams = map[string]bool{
+	"count":         true,
+	"lat":           true,
+	"lon":           true,
+	"radius_meters": true,
+}
+
+// QueryToJSON encodes query string parameters as a JSON object.
+// Repeated parameters become arrays.
+func QueryToJSON(values url.Values, skip ...string) ([]byte, error) {
+	query := make(map[string]interface{}, len(values))
+	for name, items := range values {
+		if contains(skip, name) {
+			continue
+		}
+
+		converted := make([]interface{}, 0, len(items))
+		for _, item := range items {
+			converted = append(converted, queryValue(name, item))
+		}
+
+		if len(converted) == 1 {
+			query[name] = converted[0]
+		} else {
+			query[name] = converted
+		}
+	}
+
+	return json.Marshal(query)
+}
+
+func queryValue(name string, value string) interface{} {
+	if !numericParams[name] {
+		return value
+	}
+
+	if number, err := strconv.ParseFloat(value, 64); err == nil {
+		return number
+	}
+
+	return value
+}
+
+func contains(values []string, value string) bool {
+	for _, item := range values {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
+}
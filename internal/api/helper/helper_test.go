@@ -0,0 +1,73 @@
+package helper
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type HelperTestSuite struct {
+	suite.Suite
+}
+
+func (suite *HelperTestSuite) TestQueryToJSON() {
+	values, err := url.ParseQuery("query=7707083893&count=5&ignore_cache=true&lat=55.8&locations=a&locations=b")
+	suite.Require().NoError(err)
+
+	body, err := QueryToJSON(values, ParamIgnoreCache)
+	suite.Require().NoError(err)
+	suite.JSONEq(`{"query":"7707083893","count":5,"lat":55.8,"locations":["a","b"]}`, string(body))
+}
+
+func (suite *HelperTestSuite) TestQueryToJSONIsOrderIndependent() {
+	first, err := QueryToJSON(url.Values{"ip": {"46.226.227.20"}, "language": {"en"}})
+	suite.Require().NoError(err)
+
+	second, err := QueryToJSON(url.Values{"language": {"en"}, "ip": {"46.226.227.20"}})
+	suite.Require().NoError(err)
+
+	suite.Equal(string(first), string(second))
+}
+
+func (suite *HelperTestSuite) TestClientIP() {
+	trusted, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+	suite.Require().NoError(err)
+
+	cases := []struct {
+		remote    string
+		forwarded string
+		realIP    string
+		expected  string
+	}{
+		{remote: "203.0.113.7:5000", expected: "203.0.113.7"},
+		{remote: "203.0.113.7:5000", forwarded: "198.51.100.1", expected: "203.0.113.7"},
+		{remote: "10.0.0.2:5000", forwarded: "198.51.100.1, 10.0.0.5", expected: "198.51.100.1"},
+		{remote: "192.168.1.1:5000", forwarded: "1.2.3.4, 198.51.100.1", expected: "198.51.100.1"},
+		{remote: "10.0.0.2:5000", realIP: "198.51.100.9", expected: "198.51.100.9"},
+		{remote: "10.0.0.2:5000", forwarded: "10.0.0.3", expected: "10.0.0.3"},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/iplocate/address", nil)
+		r.RemoteAddr = c.remote
+		if c.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", c.forwarded)
+		}
+		if c.realIP != "" {
+			r.Header.Set("X-Real-IP", c.realIP)
+		}
+
+		suite.Equal(c.expected, ClientIP(r, trusted), "%+v", c)
+	}
+
+	_, err = ParseTrustedProxies([]string{"not-an-ip"})
+	suite.Error(err)
+}
+
+func TestHelperTestSuite(t *testing.T) {
+	t.Parallel()
+	suite.Run(t, new(HelperTestSuite))
+}
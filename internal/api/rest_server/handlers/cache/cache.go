@@ -44,7 +44,7 @@ func New(proxyService *service.ProxyService, log *slog.Logger) http.HandlerFunc
 			path = requestBody.Path
 		}
 
-		err = proxyService.SaveToCache(path, requestBody.Query, requestBody.Body, log)
+		err = proxyService.SaveToCache(r.Context(), path, requestBody.Query, requestBody.Body, log)
 		if err != nil {
 			log.Error("Internal server error", slog.String("err", err.Error()))
 			helper.ResponseInternalError(w, err)
@@ -1,20 +1,72 @@
 package clean
 
 import (
+	"errors"
 	"io"
 	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/ilazutin/dadataproxy_go/internal/api/helper"
 	"github.com/ilazutin/dadataproxy_go/internal/service"
 )
 
+const batchPrefix = "/batch"
+
 func New(proxyService *service.ProxyService, log *slog.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		const op = "handlers.clean"
 
-		ignoreCache := r.FormValue("ignore_cache") == "true"
+		ignoreCache := r.FormValue(helper.ParamIgnoreCache) == "true"
+
+		log := log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+			slog.String("path", r.URL.Path),
+			slog.Bool("ignore_cache", ignoreCache),
+		)
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			log.Error("Cannot read body", slog.String("err", err.Error()))
+			helper.ResponseErrors(w, err)
+			return
+		}
+
+		log.Info("Decoded request body", slog.String("request", string(body)))
+
+		result, stale, err := proxyService.CleanValue(helper.RequestContext(r), r.URL.Path, string(body), ignoreCache, log)
+		if errors.Is(err, service.ErrInvalidQuery) {
+			log.Info("Invalid query", slog.String("err", err.Error()))
+			helper.ResponseErrors(w, err)
+			return
+		}
+		if err != nil {
+			log.Error("Internal server error", slog.String("err", err.Error()))
+			helper.ResponseUpstreamError(w, err)
+
+			return
+		}
+
+		if stale {
+			w.Header().Set(helper.HeaderCacheStale, "true")
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		helper.ResponseOk(w, result)
+	}
+}
+
+// NewBatch serves /batch/clean/*: the items of the array are cached one
+// by one, and the request goes to the matching /clean/* method.
+func NewBatch(proxyService *service.ProxyService, log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.clean.batch"
+
+		ignoreCache := r.FormValue(helper.ParamIgnoreCache) == "true"
+		path := strings.TrimPrefix(r.URL.Path, batchPrefix)
 
 		log := log.With(
 			slog.String("op", op),
@@ -32,14 +84,37 @@ func New(proxyService *service.ProxyService, log *slog.Logger) http.HandlerFunc
 
 		log.Info("Decoded request body", slog.String("request", string(body)))
 
-		result, err := proxyService.CleanValue(r.URL.Path, string(body), ignoreCache, log)
+		result, stale, err := proxyService.CleanBatch(helper.RequestContext(r), path, string(body), ignoreCache, log)
+
+		// Items that failed upstream are returned empty and listed in a
+		// header, unless none of the items could be served.
+		var batchErr *service.BatchError
+		if errors.As(err, &batchErr) && len(batchErr.Positions) < len(*result) {
+			log.Warn("Batch items failed", slog.Int("failed", len(batchErr.Positions)), slog.String("err", err.Error()))
+
+			positions := make([]string, len(batchErr.Positions))
+			for index, position := range batchErr.Positions {
+				positions[index] = strconv.Itoa(position)
+			}
+			w.Header().Set(helper.HeaderBatchFailed, strings.Join(positions, ","))
+			err = nil
+		}
+		if errors.Is(err, service.ErrInvalidQuery) {
+			log.Info("Invalid query", slog.String("err", err.Error()))
+			helper.ResponseErrors(w, err)
+			return
+		}
 		if err != nil {
 			log.Error("Internal server error", slog.String("err", err.Error()))
-			helper.ResponseInternalError(w, err)
+			helper.ResponseUpstreamError(w, err)
 
 			return
 		}
 
+		if stale {
+			w.Header().Set(helper.HeaderCacheStale, "true")
+		}
+
 		w.Header().Set("Content-Type", "application/json")
 		helper.ResponseOk(w, result)
 	}
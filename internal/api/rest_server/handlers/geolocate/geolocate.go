@@ -0,0 +1,55 @@
+package geolocate
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/ilazutin/dadataproxy_go/internal/api/helper"
+	"github.com/ilazutin/dadataproxy_go/internal/service"
+)
+
+func New(proxyService *service.ProxyService, log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.geolocate"
+
+		ignoreCache := r.FormValue(helper.ParamIgnoreCache) == "true"
+
+		log := log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+			slog.String("path", r.URL.Path),
+			slog.Bool("ignore_cache", ignoreCache),
+		)
+
+		body, err := helper.ReadQuery(r)
+		if err != nil {
+			log.Error("Cannot read query", slog.String("err", err.Error()))
+			helper.ResponseErrors(w, err)
+			return
+		}
+
+		log.Info("Decoded request body", slog.String("request", string(body)))
+
+		result, stale, err := proxyService.GeolocateValue(helper.RequestContext(r), r.URL.Path, string(body), ignoreCache, log)
+		if errors.Is(err, service.ErrInvalidCoordinates) {
+			log.Info("Invalid coordinates", slog.String("err", err.Error()))
+			helper.ResponseErrors(w, err)
+			return
+		}
+		if err != nil {
+			log.Error("Internal server error", slog.String("err", err.Error()))
+			helper.ResponseUpstreamError(w, err)
+
+			return
+		}
+
+		if stale {
+			w.Header().Set(helper.HeaderCacheStale, "true")
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		helper.ResponseOk(w, result)
+	}
+}
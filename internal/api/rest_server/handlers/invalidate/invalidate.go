@@ -0,0 +1,141 @@
+package invalidate
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/ilazutin/dadataproxy_go/internal/api/helper"
+	"github.com/ilazutin/dadataproxy_go/internal/service"
+)
+
+type KeysRequest struct {
+	Keys []string `json:"keys"`
+}
+
+type QueryRequest struct {
+	Path  string      `json:"path,omitempty"`
+	Query interface{} `json:"query"`
+}
+
+type PathRequest struct {
+	Path string `json:"path"`
+}
+
+type DeleteResponse struct {
+	Deleted int64 `json:"deleted"`
+}
+
+func NewByKey(proxyService *service.ProxyService, log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.invalidate.key"
+
+		log := requestLogger(log, op, r)
+
+		var requestBody KeysRequest
+		if err := decodeBody(r, &requestBody, log); err != nil {
+			helper.ResponseErrors(w, err)
+			return
+		}
+
+		if len(requestBody.Keys) == 0 {
+			helper.ResponseErrors(w, errors.New("keys are required"))
+			return
+		}
+
+		deleted, err := proxyService.DeleteKeys(r.Context(), requestBody.Keys, log)
+		if err != nil {
+			log.Error("Internal server error", slog.String("err", err.Error()))
+			helper.ResponseInternalError(w, err)
+
+			return
+		}
+
+		helper.ResponseOk(w, DeleteResponse{Deleted: deleted})
+	}
+}
+
+func NewByQuery(proxyService *service.ProxyService, log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.invalidate.query"
+
+		log := requestLogger(log, op, r)
+
+		var requestBody QueryRequest
+		if err := decodeBody(r, &requestBody, log); err != nil {
+			helper.ResponseErrors(w, err)
+			return
+		}
+
+		path := "/clean/address"
+		if requestBody.Path != "" {
+			path = requestBody.Path
+		}
+
+		deleted, err := proxyService.DeleteFromCache(r.Context(), path, requestBody.Query, log)
+		if err != nil {
+			log.Error("Internal server error", slog.String("err", err.Error()))
+			helper.ResponseInternalError(w, err)
+
+			return
+		}
+
+		helper.ResponseOk(w, DeleteResponse{Deleted: deleted})
+	}
+}
+
+func NewByPath(proxyService *service.ProxyService, log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.invalidate.path"
+
+		log := requestLogger(log, op, r)
+
+		var requestBody PathRequest
+		if err := decodeBody(r, &requestBody, log); err != nil {
+			helper.ResponseErrors(w, err)
+			return
+		}
+
+		job, err := proxyService.StartInvalidateJob(r.Context(), requestBody.Path, log)
+		if errors.Is(err, service.ErrEmptyPath) {
+			helper.ResponseErrors(w, err)
+			return
+		}
+		if err != nil {
+			log.Error("Internal server error", slog.String("err", err.Error()))
+			helper.ResponseInternalError(w, err)
+
+			return
+		}
+
+		helper.ResponseAccepted(w, job)
+	}
+}
+
+func requestLogger(log *slog.Logger, op string, r *http.Request) *slog.Logger {
+	return log.With(
+		slog.String("op", op),
+		slog.String("request_id", middleware.GetReqID(r.Context())),
+		slog.String("path", r.URL.Path),
+	)
+}
+
+func decodeBody(r *http.Request, v interface{}, log *slog.Logger) error {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Error("Cannot read body", slog.String("err", err.Error()))
+		return err
+	}
+
+	log.Info("Decoded request body", slog.String("request", string(body)))
+
+	err = json.Unmarshal(body, v)
+	if err != nil {
+		log.Error("Cannot decode body", slog.String("err", err.Error()))
+	}
+
+	return err
+}
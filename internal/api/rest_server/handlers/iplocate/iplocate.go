@@ -1,8 +1,10 @@
 package iplocate
 
 import (
-	"io"
+	"encoding/json"
+	"errors"
 	"log/slog"
+	"net"
 	"net/http"
 
 	"github.com/go-chi/chi/v5/middleware"
@@ -10,11 +12,11 @@ import (
 	"github.com/ilazutin/dadataproxy_go/internal/service"
 )
 
-func New(proxyService *service.ProxyService, log *slog.Logger) http.HandlerFunc {
+func New(proxyService *service.ProxyService, trustedProxies []*net.IPNet, log *slog.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		const op = "handlers.iplocate"
 
-		ignoreCache := r.FormValue("ignore_cache") == "true"
+		ignoreCache := r.FormValue(helper.ParamIgnoreCache) == "true"
 
 		log := log.With(
 			slog.String("op", op),
@@ -23,24 +25,58 @@ func New(proxyService *service.ProxyService, log *slog.Logger) http.HandlerFunc
 			slog.Bool("ignore_cache", ignoreCache),
 		)
 
-		body, err := io.ReadAll(r.Body)
+		body, err := helper.ReadQuery(r)
 		if err != nil {
-			log.Error("Cannot read body", slog.String("err", err.Error()))
+			log.Error("Cannot read query", slog.String("err", err.Error()))
+			helper.ResponseErrors(w, err)
+			return
+		}
+
+		body, err = withClientIP(body, helper.ClientIP(r, trustedProxies))
+		if err != nil {
+			log.Error("Cannot decode body", slog.String("err", err.Error()))
 			helper.ResponseErrors(w, err)
 			return
 		}
 
 		log.Info("Decoded request body", slog.String("request", string(body)))
 
-		result, err := proxyService.IpLocateValue(r.URL.Path, string(body), ignoreCache, log)
+		result, stale, err := proxyService.IpLocateValue(helper.RequestContext(r), r.URL.Path, string(body), ignoreCache, log)
+		if errors.Is(err, service.ErrInvalidQuery) {
+			log.Info("Invalid query", slog.String("err", err.Error()))
+			helper.ResponseErrors(w, err)
+			return
+		}
 		if err != nil {
 			log.Error("Internal server error", slog.String("err", err.Error()))
-			helper.ResponseInternalError(w, err)
+			helper.ResponseUpstreamError(w, err)
 
 			return
 		}
 
+		if stale {
+			w.Header().Set(helper.HeaderCacheStale, "true")
+		}
+
 		w.Header().Set("Content-Type", "application/json")
 		helper.ResponseOk(w, result)
 	}
 }
+
+// withClientIP fills in the caller's address when the query has no ip.
+func withClientIP(body []byte, clientIP string) ([]byte, error) {
+	query := map[string]interface{}{}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &query); err != nil {
+			return nil, err
+		}
+	}
+
+	if ip, _ := query["ip"].(string); ip != "" {
+		return body, nil
+	}
+
+	query["ip"] = clientIP
+
+	return json.Marshal(query)
+}
@@ -0,0 +1,171 @@
+package jobs
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/ilazutin/dadataproxy_go/internal/api/helper"
+	"github.com/ilazutin/dadataproxy_go/internal/service"
+)
+
+const (
+	paramID     = "id"
+	paramType   = "type"
+	paramColumn = "column"
+	formFile    = "file"
+
+	// maxFileSize limits the uploaded file kept in memory.
+	maxFileSize = 32 << 20
+)
+
+// NewClean starts a job cleaning one column of a CSV file. The file is
+// the "file" part of a multipart form or the whole request body.
+func NewClean(proxyService *service.ProxyService, log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.jobs.clean"
+
+		log := requestLogger(log, op, r)
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxFileSize)
+
+		file, err := readFile(r)
+		if err != nil {
+			log.Error("Cannot read file", slog.String("err", err.Error()))
+			helper.ResponseErrors(w, err)
+			return
+		}
+
+		job, err := proxyService.StartFileJob(r.Context(), file, r.FormValue(paramType), r.FormValue(paramColumn), log)
+		if err != nil {
+			log.Error("Cannot start job", slog.String("err", err.Error()))
+			helper.ResponseErrors(w, err)
+			return
+		}
+
+		helper.ResponseAccepted(w, job)
+	}
+}
+
+func NewStatus(proxyService *service.ProxyService, log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.jobs.status"
+
+		log := requestLogger(log, op, r)
+
+		job, err := proxyService.Job(r.Context(), chi.URLParam(r, paramID))
+		if errors.Is(err, service.ErrJobNotFound) {
+			helper.ResponseNotFound(w, helper.ErrorResponse{Errors: []string{err.Error()}})
+			return
+		}
+		if err != nil {
+			log.Error("Internal server error", slog.String("err", err.Error()))
+			helper.ResponseInternalError(w, err)
+			return
+		}
+
+		helper.ResponseOk(w, job)
+	}
+}
+
+// NewErrors returns the error log of a job.
+func NewErrors(proxyService *service.ProxyService, log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.jobs.errors"
+
+		log := requestLogger(log, op, r)
+
+		jobErrors, err := proxyService.JobErrors(r.Context(), chi.URLParam(r, paramID))
+		if errors.Is(err, service.ErrJobNotFound) {
+			helper.ResponseNotFound(w, helper.ErrorResponse{Errors: []string{err.Error()}})
+			return
+		}
+		if err != nil {
+			log.Error("Internal server error", slog.String("err", err.Error()))
+			helper.ResponseInternalError(w, err)
+			return
+		}
+
+		helper.ResponseOk(w, jobErrors)
+	}
+}
+
+func NewCancel(proxyService *service.ProxyService, log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.jobs.cancel"
+
+		log := requestLogger(log, op, r)
+
+		job, err := proxyService.CancelJob(r.Context(), chi.URLParam(r, paramID), log)
+		switch {
+		case errors.Is(err, service.ErrJobNotFound):
+			helper.ResponseNotFound(w, helper.ErrorResponse{Errors: []string{err.Error()}})
+			return
+		case errors.Is(err, service.ErrJobFinished):
+			helper.ResponseErrors(w, err)
+			return
+		case err != nil:
+			log.Error("Internal server error", slog.String("err", err.Error()))
+			helper.ResponseInternalError(w, err)
+			return
+		}
+
+		helper.ResponseOk(w, job)
+	}
+}
+
+// NewResult downloads the cleaned file of a finished job.
+func NewResult(proxyService *service.ProxyService, log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.jobs.result"
+
+		log := requestLogger(log, op, r)
+
+		id := chi.URLParam(r, paramID)
+
+		result, err := proxyService.FileJobResult(r.Context(), id)
+		switch {
+		case errors.Is(err, service.ErrJobNotFound):
+			helper.ResponseNotFound(w, helper.ErrorResponse{Errors: []string{err.Error()}})
+			return
+		case errors.Is(err, service.ErrJobNotDone):
+			helper.ResponseErrors(w, err)
+			return
+		case err != nil:
+			log.Error("Internal server error", slog.String("err", err.Error()))
+			helper.ResponseInternalError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+id+`.csv"`)
+		w.WriteHeader(http.StatusOK)
+		w.Write(result) //nolint:errcheck
+	}
+}
+
+func readFile(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		return io.ReadAll(r.Body)
+	}
+
+	file, _, err := r.FormFile(formFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return io.ReadAll(file)
+}
+
+func requestLogger(log *slog.Logger, op string, r *http.Request) *slog.Logger {
+	return log.With(
+		slog.String("op", op),
+		slog.String("request_id", middleware.GetReqID(r.Context())),
+		slog.String("path", r.URL.Path),
+	)
+}
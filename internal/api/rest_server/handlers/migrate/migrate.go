@@ -1,17 +1,21 @@
 package migrate
 
 import (
+	"errors"
 	"log/slog"
 	"net/http"
+	"strconv"
 
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/ilazutin/dadataproxy_go/internal/api/helper"
 	"github.com/ilazutin/dadataproxy_go/internal/service"
 )
 
+const paramDryRun = "dry_run"
+
 func New(proxyService *service.ProxyService, log *slog.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		const op = "handlers.cache"
+		const op = "handlers.migrate"
 
 		log := log.With(
 			slog.String("op", op),
@@ -19,7 +23,21 @@ func New(proxyService *service.ProxyService, log *slog.Logger) http.HandlerFunc
 			slog.String("path", r.URL.Path),
 		)
 
-		err := proxyService.MigrateCache(log)
+		fromVersion := 0
+		if from := r.FormValue("from"); from != "" {
+			var err error
+			fromVersion, err = strconv.Atoi(from)
+			if err != nil {
+				helper.ResponseErrors(w, err)
+				return
+			}
+		}
+
+		job, err := proxyService.StartMigrateJob(r.Context(), fromVersion, log)
+		if errors.Is(err, service.ErrInvalidVersion) {
+			helper.ResponseErrors(w, err)
+			return
+		}
 		if err != nil {
 			log.Error("Internal server error", slog.String("err", err.Error()))
 			helper.ResponseInternalError(w, err)
@@ -27,6 +45,59 @@ func New(proxyService *service.ProxyService, log *slog.Logger) http.HandlerFunc
 			return
 		}
 
-		helper.ResponseOk(w, nil)
+		helper.ResponseAccepted(w, job)
+	}
+}
+
+// NewList lists the registered migrations and when they were applied.
+func NewList(proxyService *service.ProxyService, log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.migrate.list"
+
+		log := log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+			slog.String("path", r.URL.Path),
+		)
+
+		migrations, err := proxyService.Migrations(r.Context())
+		if err != nil {
+			log.Error("Internal server error", slog.String("err", err.Error()))
+			helper.ResponseInternalError(w, err)
+
+			return
+		}
+
+		helper.ResponseOk(w, migrations)
+	}
+}
+
+// NewRun applies the pending migrations in a job; dry_run=true only
+// counts the entries they would migrate.
+func NewRun(proxyService *service.ProxyService, log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.migrate.run"
+
+		dryRun := r.FormValue(paramDryRun) == "true"
+
+		log := log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+			slog.String("path", r.URL.Path),
+			slog.Bool("dry_run", dryRun),
+		)
+
+		job, err := proxyService.StartMigrationsJob(r.Context(), dryRun, log)
+		switch {
+		case errors.Is(err, service.ErrMigrationsRunning):
+			helper.ResponseErrors(w, err)
+			return
+		case err != nil:
+			log.Error("Internal server error", slog.String("err", err.Error()))
+			helper.ResponseInternalError(w, err)
+			return
+		}
+
+		helper.ResponseAccepted(w, job)
 	}
 }
@@ -0,0 +1,68 @@
+package passthrough
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/ilazutin/dadataproxy_go/internal/api/helper"
+	"github.com/ilazutin/dadataproxy_go/internal/config"
+	"github.com/ilazutin/dadataproxy_go/internal/service"
+)
+
+func New(proxyService *service.ProxyService, route config.PassthroughRoute, log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.passthrough"
+
+		query := r.URL.Query()
+		ignoreCache := query.Get(helper.ParamIgnoreCache) == "true"
+		query.Del(helper.ParamIgnoreCache)
+
+		log := log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+			slog.String("path", r.URL.Path),
+			slog.String("host", route.Host),
+			slog.Bool("ignore_cache", ignoreCache),
+		)
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			log.Error("Cannot read body", slog.String("err", err.Error()))
+			helper.ResponseErrors(w, err)
+			return
+		}
+
+		data := body
+		if len(data) == 0 {
+			data, err = helper.QueryToJSON(query)
+			if err != nil {
+				log.Error("Cannot read query", slog.String("err", err.Error()))
+				helper.ResponseErrors(w, err)
+				return
+			}
+		}
+
+		result, stale, err := proxyService.PassthroughValue(helper.RequestContext(r), route, r.Method, r.URL.Path, query.Encode(), string(body), string(data), ignoreCache, log)
+		if errors.Is(err, service.ErrInvalidQuery) {
+			log.Info("Invalid query", slog.String("err", err.Error()))
+			helper.ResponseErrors(w, err)
+			return
+		}
+		if err != nil {
+			log.Error("Internal server error", slog.String("err", err.Error()))
+			helper.ResponseUpstreamError(w, err)
+
+			return
+		}
+
+		if stale {
+			w.Header().Set(helper.HeaderCacheStale, "true")
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		helper.ResponseOk(w, result)
+	}
+}
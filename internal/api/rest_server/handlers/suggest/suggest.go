@@ -1,7 +1,7 @@
 package suggest
 
 import (
-	"io"
+	"errors"
 	"log/slog"
 	"net/http"
 
@@ -14,7 +14,7 @@ func New(proxyService *service.ProxyService, log *slog.Logger) http.HandlerFunc
 	return func(w http.ResponseWriter, r *http.Request) {
 		const op = "handlers.suggest"
 
-		ignoreCache := r.FormValue("ignore_cache") == "true"
+		ignoreCache := r.FormValue(helper.ParamIgnoreCache) == "true"
 
 		log := log.With(
 			slog.String("op", op),
@@ -23,23 +23,32 @@ func New(proxyService *service.ProxyService, log *slog.Logger) http.HandlerFunc
 			slog.Bool("ignore_cache", ignoreCache),
 		)
 
-		body, err := io.ReadAll(r.Body)
+		body, err := helper.ReadQuery(r)
 		if err != nil {
-			log.Error("Cannot read body", slog.String("err", err.Error()))
+			log.Error("Cannot read query", slog.String("err", err.Error()))
 			helper.ResponseErrors(w, err)
 			return
 		}
 
 		log.Info("Decoded request body", slog.String("request", string(body)))
 
-		result, err := proxyService.SuggestValue(r.URL.Path, string(body), ignoreCache, log)
+		result, stale, err := proxyService.SuggestValue(helper.RequestContext(r), r.URL.Path, string(body), ignoreCache, log)
+		if errors.Is(err, service.ErrInvalidQuery) {
+			log.Info("Invalid query", slog.String("err", err.Error()))
+			helper.ResponseErrors(w, err)
+			return
+		}
 		if err != nil {
 			log.Error("Internal server error", slog.String("err", err.Error()))
-			helper.ResponseInternalError(w, err)
+			helper.ResponseUpstreamError(w, err)
 
 			return
 		}
 
+		if stale {
+			w.Header().Set(helper.HeaderCacheStale, "true")
+		}
+
 		w.Header().Set("Content-Type", "application/json")
 		helper.ResponseOk(w, result)
 	}
@@ -0,0 +1,27 @@
+package upstream
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/ilazutin/dadataproxy_go/internal/api/helper"
+	"github.com/ilazutin/dadataproxy_go/internal/service"
+)
+
+func New(proxyService *service.ProxyService, log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.upstream"
+
+		log := log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+			slog.String("path", r.URL.Path),
+		)
+
+		status := proxyService.UpstreamStatus()
+		log.Debug("Upstream status", slog.Any("status", status))
+
+		helper.ResponseOk(w, status)
+	}
+}
@@ -0,0 +1,32 @@
+package usage
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/ilazutin/dadataproxy_go/internal/api/helper"
+	"github.com/ilazutin/dadataproxy_go/internal/service"
+)
+
+const paramDate = "date"
+
+func New(proxyService *service.ProxyService, log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.usage"
+
+		date := r.URL.Query().Get(paramDate)
+
+		log := log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+			slog.String("path", r.URL.Path),
+			slog.String("date", date),
+		)
+
+		stats := proxyService.UsageStats(r.Context(), date, log)
+		log.Debug("Usage stats", slog.Any("stats", stats))
+
+		helper.ResponseOk(w, stats)
+	}
+}
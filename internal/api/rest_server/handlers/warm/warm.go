@@ -0,0 +1,58 @@
+package warm
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/ilazutin/dadataproxy_go/internal/api/helper"
+	"github.com/ilazutin/dadataproxy_go/internal/service"
+)
+
+type WarmRequest struct {
+	Path    string            `json:"path"`
+	Queries []json.RawMessage `json:"queries"`
+}
+
+func New(proxyService *service.ProxyService, log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.warm"
+
+		log := log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+			slog.String("path", r.URL.Path),
+		)
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			log.Error("Cannot read body", slog.String("err", err.Error()))
+			helper.ResponseErrors(w, err)
+			return
+		}
+
+		var requestBody WarmRequest
+		if err := json.Unmarshal(body, &requestBody); err != nil {
+			log.Error("Cannot decode body", slog.String("err", err.Error()))
+			helper.ResponseErrors(w, err)
+			return
+		}
+
+		job, err := proxyService.StartWarmJob(r.Context(), requestBody.Path, requestBody.Queries, log)
+		if errors.Is(err, service.ErrEmptyPath) || errors.Is(err, service.ErrEmptyWarm) {
+			helper.ResponseErrors(w, err)
+			return
+		}
+		if err != nil {
+			log.Error("Internal server error", slog.String("err", err.Error()))
+			helper.ResponseInternalError(w, err)
+
+			return
+		}
+
+		helper.ResponseAccepted(w, job)
+	}
+}
@@ -3,6 +3,7 @@ package restserver
 import (
 	"context"
 	"log/slog"
+	"net"
 	"net/http"
 	"time"
 
@@ -11,10 +12,19 @@ import (
 
 	"github.com/ilazutin/dadataproxy_go/internal/api/rest_server/handlers/cache"
 	"github.com/ilazutin/dadataproxy_go/internal/api/rest_server/handlers/clean"
+	"github.com/ilazutin/dadataproxy_go/internal/api/rest_server/handlers/geolocate"
+	"github.com/ilazutin/dadataproxy_go/internal/api/rest_server/handlers/invalidate"
 	"github.com/ilazutin/dadataproxy_go/internal/api/rest_server/handlers/iplocate"
+	"github.com/ilazutin/dadataproxy_go/internal/api/rest_server/handlers/jobs"
 	"github.com/ilazutin/dadataproxy_go/internal/api/rest_server/handlers/migrate"
+	"github.com/ilazutin/dadataproxy_go/internal/api/rest_server/handlers/passthrough"
+	"github.com/ilazutin/dadataproxy_go/internal/api/rest_server/handlers/stats"
 	"github.com/ilazutin/dadataproxy_go/internal/api/rest_server/handlers/suggest"
+	"github.com/ilazutin/dadataproxy_go/internal/api/rest_server/handlers/upstream"
+	"github.com/ilazutin/dadataproxy_go/internal/api/rest_server/handlers/usage"
+	"github.com/ilazutin/dadataproxy_go/internal/api/rest_server/handlers/warm"
 	mwLogger "github.com/ilazutin/dadataproxy_go/internal/api/rest_server/middleware/logger"
+	"github.com/ilazutin/dadataproxy_go/internal/config"
 	service "github.com/ilazutin/dadataproxy_go/internal/service"
 )
 
@@ -23,7 +33,7 @@ type ProxyServer struct {
 	logger *slog.Logger
 }
 
-func New(address string, timeout time.Duration, idleTimeout time.Duration, proxyService *service.ProxyService, logger *slog.Logger) *ProxyServer {
+func New(address string, timeout time.Duration, idleTimeout time.Duration, trustedProxies []*net.IPNet, routes []config.PassthroughRoute, proxyService *service.ProxyService, logger *slog.Logger) *ProxyServer {
 	router := chi.NewRouter()
 
 	router.Use(middleware.RequestID)
@@ -32,18 +42,56 @@ func New(address string, timeout time.Duration, idleTimeout time.Duration, proxy
 	router.Use(middleware.URLFormat)
 
 	router.Post("/suggest/*", suggest.New(proxyService, logger))
+	router.Get("/suggest/*", suggest.New(proxyService, logger))
 
-	router.Post("/iplocate/*", iplocate.New(proxyService, logger))
+	router.Post("/iplocate/*", iplocate.New(proxyService, trustedProxies, logger))
+	router.Get("/iplocate/*", iplocate.New(proxyService, trustedProxies, logger))
 
 	router.Post("/clean/*", clean.New(proxyService, logger))
+	router.Post("/batch/clean/*", clean.NewBatch(proxyService, logger))
 
 	router.Post("/findById/*", suggest.New(proxyService, logger))
+	router.Get("/findById/*", suggest.New(proxyService, logger))
 
-	router.Post("/geolocate/*", suggest.New(proxyService, logger))
+	router.Post("/geolocate/*", geolocate.New(proxyService, logger))
+	router.Get("/geolocate/*", geolocate.New(proxyService, logger))
 
 	router.Post("/cache", cache.New(proxyService, logger))
 
+	router.Delete("/cache", invalidate.NewByQuery(proxyService, logger))
+
+	router.Delete("/cache/keys", invalidate.NewByKey(proxyService, logger))
+
+	router.Delete("/cache/path", invalidate.NewByPath(proxyService, logger))
+
+	router.Get("/cache/stats", stats.New(proxyService, logger))
+
+	router.Post("/cache/warm", warm.New(proxyService, logger))
+
 	router.Post("/migrate", migrate.New(proxyService, logger))
+	router.Get("/migrations", migrate.NewList(proxyService, logger))
+	router.Post("/migrations", migrate.NewRun(proxyService, logger))
+
+	router.Get("/upstream", upstream.New(proxyService, logger))
+
+	router.Get("/stats", usage.New(proxyService, logger))
+
+	router.Post("/jobs/clean", jobs.NewClean(proxyService, logger))
+	router.Get("/jobs/{id}", jobs.NewStatus(proxyService, logger))
+	router.Delete("/jobs/{id}", jobs.NewCancel(proxyService, logger))
+	router.Get("/jobs/{id}/errors", jobs.NewErrors(proxyService, logger))
+	router.Get("/jobs/{id}/result", jobs.NewResult(proxyService, logger))
+
+	for _, route := range routes {
+		methods := route.Methods
+		if len(methods) == 0 {
+			methods = []string{http.MethodPost}
+		}
+
+		for _, method := range methods {
+			router.Method(method, route.Path, passthrough.New(proxyService, route, logger))
+		}
+	}
 
 	return &ProxyServer{
 		server: &http.Server{
@@ -59,14 +107,20 @@ func New(address string, timeout time.Duration, idleTimeout time.Duration, proxy
 	}
 }
 
-func (o *ProxyServer) Run(context.Context) error {
+// Run serves requests until Shutdown. Every request context derives
+// from ctx, so cancelling it aborts in-flight work.
+func (o *ProxyServer) Run(ctx context.Context) error {
+	o.server.BaseContext = func(net.Listener) context.Context {
+		return ctx
+	}
+
 	o.logger.Info("Proxy server is running", slog.String("address", o.server.Addr))
 	return o.server.ListenAndServe()
 }
 
-func (o *ProxyServer) Shutdown(err error) {
-	o.logger.Info("Proxy server was interrupted", slog.String("error", err.Error()))
-	if shutdownErr := o.server.Shutdown(context.Background()); shutdownErr != nil {
+func (o *ProxyServer) Shutdown(ctx context.Context) {
+	o.logger.Info("Proxy server is shutting down")
+	if err := o.server.Shutdown(ctx); err != nil {
 		o.logger.Error("Proxy server shutdown error", slog.String("error", err.Error()))
 	}
 }
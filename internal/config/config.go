@@ -9,27 +9,173 @@ import (
 )
 
 type Config struct {
-	Env        string `yaml:"env" env-required:"true" env-default:"local"`
-	Redis      `yaml:"redis" env-required:"true"`
-	HTTPServer `yaml:"http_server" env-required:"true"`
-	DaData     `yaml:"dadata" env-required:"true"`
+	Env         string `yaml:"env" env-required:"true" env-default:"local"`
+	Storage     `yaml:"storage"`
+	Redis       `yaml:"redis"`
+	Cache       `yaml:"cache"`
+	HTTPServer  `yaml:"http_server" env-required:"true"`
+	DaData      `yaml:"dadata" env-required:"true"`
+	Passthrough `yaml:"passthrough"`
+}
+
+type Storage struct {
+	Type   string `yaml:"type" env-default:"redis"`
+	Memory Memory `yaml:"memory"`
+	Tiered Tiered `yaml:"tiered"`
+}
+
+type Memory struct {
+	Size int `yaml:"size" env-default:"100000"`
+}
+
+type Tiered struct {
+	Size   int           `yaml:"size" env-default:"10000"`
+	Expire time.Duration `yaml:"expire" env-default:"60s"`
 }
 
 type Redis struct {
-	Url      string        `yaml:"url" env-required:"true"`
+	Url      string        `yaml:"url" env-default:"localhost:6379"`
 	Password string        `yaml:"password"`
 	Expire   time.Duration `yaml:"expire" env-default:"2592000s"`
 }
 
+// Cache configures the cache keys and entries. KeyVersion namespaces the
+// keys and is bumped whenever their derivation changes: version 2 hashes
+// the compact query, version 3 the query rewritten by Normalize. The keys
+// of version 2 and older are not moved into version 3 as they are: the
+// cleaned addresses are re-keyed from their source and the other entries
+// expire.
+type Cache struct {
+	KeyPrefix  string                   `yaml:"key_prefix" env-default:"dadataproxy"`
+	KeyVersion int                      `yaml:"key_version" env-default:"3"`
+	ScanMatch  string                   `yaml:"scan_match" env-default:"*"`
+	ScanCount  int64                    `yaml:"scan_count" env-default:"1000"`
+	Policies   map[string]CachePolicy   `yaml:"policies"`
+	Pricing    map[string]float64       `yaml:"pricing"`
+	Normalize  map[string]Normalization `yaml:"normalize"`
+
+	MigrateOnStartup bool `yaml:"migrate_on_startup"`
+}
+
+// Normalization rewrites queries before the cache key is derived, so
+// equivalent queries share a cache entry. Only the query texts are
+// rewritten; other strings of the query are kept as they are. Punctuation
+// suits the addresses, whose cleaner ignores it, rather than emails or
+// phones. Defaults drops a top level parameter equal to its default, Drop
+// drops it whatever the value.
+type Normalization struct {
+	Whitespace  bool              `yaml:"whitespace"`
+	Case        bool              `yaml:"case"`
+	Punctuation bool              `yaml:"punctuation"`
+	Yo          bool              `yaml:"yo"`
+	Defaults    map[string]string `yaml:"defaults"`
+	Drop        []string          `yaml:"drop"`
+}
+
+type CachePolicy struct {
+	TTL      time.Duration `yaml:"ttl"`
+	Disabled bool          `yaml:"disabled"`
+	Stale    bool          `yaml:"stale"`
+	StaleTTL time.Duration `yaml:"stale_ttl"`
+}
+
 type HTTPServer struct {
-	Address     string        `yaml:"address" env-default:"localhost:8082"`
-	Timeout     time.Duration `yaml:"timeout" env-default:"4s"`
-	IdleTimeout time.Duration `yaml:"idle_timeout" env-default:"60s"`
+	Address        string        `yaml:"address" env-default:"localhost:8082"`
+	Timeout        time.Duration `yaml:"timeout" env-default:"4s"`
+	IdleTimeout    time.Duration `yaml:"idle_timeout" env-default:"60s"`
+	TrustedProxies []string      `yaml:"trusted_proxies"`
+}
+
+type Passthrough struct {
+	Routes []PassthroughRoute `yaml:"routes"`
+}
+
+// PassthroughRoute exposes a DaData endpoint without a dedicated handler.
+// Host is one of clean, suggest or profile.
+type PassthroughRoute struct {
+	Path    string   `yaml:"path"`
+	Methods []string `yaml:"methods"`
+	Host    string   `yaml:"host"`
+	Cache   bool     `yaml:"cache"`
 }
 
 type DaData struct {
-	Token     string `yaml:"token" env-required:"true"`
-	SecretKey string `yaml:"secret" env-required:"true"`
+	Token        string         `yaml:"token"`
+	SecretKey    string         `yaml:"secret"`
+	Credentials  []Credential   `yaml:"credentials"`
+	KeySelection string         `yaml:"key_selection" env-default:"round_robin"`
+	CleanUrl     string         `yaml:"clean_url" env-default:"https://cleaner.dadata.ru/api/v1"`
+	SuggestUrl   string         `yaml:"suggest_url" env-default:"https://suggestions.dadata.ru/suggestions/api/4_1/rs"`
+	ProfileUrl   string         `yaml:"profile_url" env-default:"https://dadata.ru/api/v2"`
+	Proxy        string         `yaml:"proxy"`
+	Timeout      time.Duration  `yaml:"timeout" env-default:"10s"`
+	TLS          DaDataTLS      `yaml:"tls"`
+	Pool         DaDataPool     `yaml:"pool"`
+	Retry        DaDataRetry    `yaml:"retry"`
+	Breaker      CircuitBreaker `yaml:"breaker"`
+	RateLimit    RateLimit      `yaml:"rate_limit"`
+}
+
+type Credential struct {
+	Name   string `yaml:"name"`
+	Token  string `yaml:"token"`
+	Secret string `yaml:"secret"`
+	Weight int    `yaml:"weight"`
+}
+
+type DaDataTLS struct {
+	CAFile             string `yaml:"ca_file"`
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+type DaDataPool struct {
+	MaxIdleConns        int           `yaml:"max_idle_conns" env-default:"100"`
+	MaxIdleConnsPerHost int           `yaml:"max_idle_conns_per_host" env-default:"10"`
+	MaxConnsPerHost     int           `yaml:"max_conns_per_host" env-default:"0"`
+	IdleConnTimeout     time.Duration `yaml:"idle_conn_timeout" env-default:"90s"`
+}
+
+type DaDataRetry struct {
+	Clean   RetryPolicy `yaml:"clean"`
+	Suggest RetryPolicy `yaml:"suggest"`
+}
+
+type RetryPolicy struct {
+	MaxAttempts    int           `yaml:"max_attempts" env-default:"3"`
+	InitialBackoff time.Duration `yaml:"initial_backoff" env-default:"100ms"`
+	MaxBackoff     time.Duration `yaml:"max_backoff" env-default:"1s"`
+	Deadline       time.Duration `yaml:"deadline" env-default:"3s"`
+	RetryBilled    bool          `yaml:"retry_billed"`
+}
+
+type CircuitBreaker struct {
+	FailureThreshold int           `yaml:"failure_threshold" env-default:"5"`
+	OpenTimeout      time.Duration `yaml:"open_timeout" env-default:"30s"`
+	HalfOpenRequests int           `yaml:"half_open_requests" env-default:"1"`
+}
+
+// Rate limit modes: queue waits for a token, reject fails at once and
+// cache answers from the cache instead.
+const (
+	RateLimitQueue  = "queue"
+	RateLimitReject = "reject"
+	RateLimitCache  = "cache"
+)
+
+type RateLimit struct {
+	Mode    string     `yaml:"mode" env-default:"queue"`
+	Clean   RateBudget `yaml:"clean"`
+	Suggest RateBudget `yaml:"suggest"`
+}
+
+// RateBudget limits the requests of one API family made with one key:
+// DaData applies its limits to every token, so each key of the pool has
+// a budget of its own.
+type RateBudget struct {
+	PerSecond float64 `yaml:"per_second"`
+	Burst     int     `yaml:"burst"`
+	PerDay    int64   `yaml:"per_day"`
 }
 
 func MustLoad() *Config {
@@ -47,5 +193,11 @@ func MustLoad() *Config {
 		log.Fatalf("cannot read config: %s with error %s", configPath, err)
 	}
 
+	switch cfg.DaData.RateLimit.Mode {
+	case RateLimitQueue, RateLimitReject, RateLimitCache:
+	default:
+		log.Fatalf("unknown dadata rate limit mode: %q", cfg.DaData.RateLimit.Mode)
+	}
+
 	return &cfg
 }
@@ -0,0 +1,141 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+var (
+	ErrEmptyWarm         = errors.New("queries are required")
+	ErrMigrationsRunning = errors.New("migrations job is already pending or running")
+)
+
+type migrateJobParams struct {
+	From int `json:"from"`
+}
+
+type migrationsJobParams struct {
+	DryRun bool `json:"dry_run"`
+}
+
+type warmJobParams struct {
+	Path    string            `json:"path"`
+	Queries []json.RawMessage `json:"queries"`
+}
+
+type invalidateJobParams struct {
+	Path string `json:"path"`
+}
+
+// StartMigrateJob runs MigrateCache in the background.
+func (s ProxyService) StartMigrateJob(ctx context.Context, fromVersion int, logger *slog.Logger) (*Job, error) {
+	if fromVersion < legacyKeyVersion || fromVersion >= s.config.KeyVersion {
+		return nil, ErrInvalidVersion
+	}
+
+	return s.startJob(ctx, JobKindMigrate, migrateJobParams{From: fromVersion}, logger)
+}
+
+// StartMigrationsJob runs RunMigrations in the background. Migrations
+// are applied by one job at a time; a dry run can always be started.
+func (s ProxyService) StartMigrationsJob(ctx context.Context, dryRun bool, logger *slog.Logger) (*Job, error) {
+	if !dryRun {
+		job, err := s.activeJob(ctx, JobKindMigrations, func(job *Job) bool {
+			var params migrationsJobParams
+			return json.Unmarshal(job.Params, &params) == nil && !params.DryRun
+		})
+		if err != nil {
+			return nil, err
+		}
+		if job != nil {
+			return nil, fmt.Errorf("%w: %s", ErrMigrationsRunning, job.ID)
+		}
+	}
+
+	return s.startJob(ctx, JobKindMigrations, migrationsJobParams{DryRun: dryRun}, logger)
+}
+
+// StartWarmJob requests every query of path from DaData bypassing the
+// cache, so the cache holds fresh values.
+func (s ProxyService) StartWarmJob(ctx context.Context, path string, queries []json.RawMessage, logger *slog.Logger) (*Job, error) {
+	if s.pathSegment(path) == "" {
+		return nil, ErrEmptyPath
+	}
+	if len(queries) == 0 {
+		return nil, ErrEmptyWarm
+	}
+
+	return s.startJob(ctx, JobKindWarm, warmJobParams{Path: path, Queries: queries}, logger)
+}
+
+// StartInvalidateJob runs DeleteByPath in the background.
+func (s ProxyService) StartInvalidateJob(ctx context.Context, path string, logger *slog.Logger) (*Job, error) {
+	if s.pathSegment(path) == "" {
+		return nil, ErrEmptyPath
+	}
+
+	return s.startJob(ctx, JobKindInvalidate, invalidateJobParams{Path: path}, logger)
+}
+
+func (s ProxyService) migrateJob(params migrateJobParams) jobFunc {
+	return func(ctx context.Context, progress *jobProgress) (interface{}, error) {
+		migrated, err := s.migrateCache(ctx, params.From, progress, progress.logger)
+
+		return map[string]int64{"migrated": migrated}, err
+	}
+}
+
+func (s ProxyService) migrationsJob(params migrationsJobParams) jobFunc {
+	return func(ctx context.Context, progress *jobProgress) (interface{}, error) {
+		return s.runMigrations(ctx, params.DryRun, progress, progress.logger)
+	}
+}
+
+func (s ProxyService) warmJob(params warmJobParams) jobFunc {
+	return func(ctx context.Context, progress *jobProgress) (interface{}, error) {
+		progress.setTotal(int64(len(params.Queries)))
+
+		var warmed int64
+		for _, query := range params.Queries {
+			if err := s.warm(ctx, params.Path, string(query), progress.logger); err != nil {
+				if ctx.Err() != nil {
+					return nil, err
+				}
+				progress.fail(ctx, string(query), err)
+			} else {
+				warmed++
+			}
+			progress.advance(ctx, 1)
+		}
+
+		return map[string]int64{"warmed": warmed}, nil
+	}
+}
+
+func (s ProxyService) invalidateJob(params invalidateJobParams) jobFunc {
+	return func(ctx context.Context, progress *jobProgress) (interface{}, error) {
+		deleted, err := s.deleteByPath(ctx, params.Path, progress, progress.logger)
+
+		return map[string]int64{"deleted": deleted}, err
+	}
+}
+
+// warm refreshes the cached value of one query with the method serving
+// path.
+func (s ProxyService) warm(ctx context.Context, path string, query string, logger *slog.Logger) error {
+	var err error
+	switch urlPath := routePath(path); {
+	case strings.HasPrefix(urlPath, "/clean/"):
+		_, _, err = s.CleanValue(ctx, path, query, true, logger)
+	case strings.HasPrefix(urlPath, "/iplocate/"):
+		_, _, err = s.IpLocateValue(ctx, path, query, true, logger)
+	default:
+		_, _, err = s.SuggestValue(ctx, path, query, true, logger)
+	}
+
+	return err
+}
@@ -0,0 +1,229 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+
+	"github.com/ilazutin/dadataproxy_go/internal/service/dadata"
+)
+
+// batchSize is the largest array the cleaner accepts in one request.
+const batchSize = 50
+
+var (
+	ErrEmptyBatch    = fmt.Errorf("%w: batch is empty", ErrInvalidQuery)
+	ErrBatchMismatch = errors.New("cleaner returned a different number of items")
+)
+
+// BatchError lists the positions of the batch items that could be
+// neither cleaned nor served from the stale cache; Err is the upstream
+// error. The other items of the result are filled.
+type BatchError struct {
+	Positions []int
+	Err       error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("%d batch items failed: %s", len(e.Positions), e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// batchItem is one distinct item of a batch and the positions it takes.
+// raw is the item as the client sent it first.
+type batchItem struct {
+	raw       json.RawMessage
+	key       string
+	positions []int
+}
+
+// CleanBatch cleans every item of the data array on its own: items are
+// read from the cache under the key a single item request would use, and
+// only the misses go upstream, batchSize at a time. The result keeps the
+// order of data. Items that failed upstream and have no stale copy are
+// left empty and reported by a *BatchError next to the result.
+func (s ProxyService) CleanBatch(ctx context.Context, path string, data string, ignoreCache bool, logger *slog.Logger) (*dadata.DaDataClean, bool, error) {
+	var items []json.RawMessage
+	if err := json.Unmarshal([]byte(data), &items); err != nil {
+		return nil, false, fmt.Errorf("%w: %s", ErrInvalidQuery, err)
+	}
+	if len(items) == 0 {
+		return nil, false, ErrEmptyBatch
+	}
+
+	policy := s.policy(path)
+	result := make(dadata.DaDataClean, len(items))
+
+	var (
+		misses []*batchItem
+		byKey  = make(map[string]*batchItem, len(items))
+	)
+	for position, raw := range items {
+		query, err := s.normalizeQuery(path, "["+string(raw)+"]")
+		if err != nil {
+			return nil, false, err
+		}
+
+		key := s.makeKey(path, query)
+		if item, ok := byKey[key]; ok {
+			item.positions = append(item.positions, position)
+			// An item read from the cache is filled already.
+			result[position] = result[item.positions[0]]
+			continue
+		}
+
+		item := &batchItem{raw: raw, key: key, positions: []int{position}}
+		byKey[key] = item
+
+		if !ignoreCache && !policy.Disabled {
+			if value, ok := s.readBatchItem(ctx, key); ok {
+				s.usage.hit(s.usageEndpoint(ctx, path))
+				item.fill(result, value)
+				continue
+			}
+		}
+
+		misses = append(misses, item)
+	}
+
+	logger = logger.With(
+		slog.String("path", path),
+		slog.Int("items", len(items)),
+		slog.Int("misses", len(misses)),
+	)
+	logger.Info("Batch read from cache")
+
+	var (
+		stale     bool
+		failedErr error
+		failed    []int
+	)
+	for start := 0; start < len(misses); start += batchSize {
+		chunk := misses[start:min(start+batchSize, len(misses))]
+
+		chunkStale, chunkFailed, err := s.cleanChunk(ctx, path, chunk, result, logger)
+		if err != nil && len(chunkFailed) == 0 {
+			return nil, false, err
+		}
+		stale = stale || chunkStale
+
+		for _, item := range chunkFailed {
+			failed = append(failed, item.positions...)
+			failedErr = err
+		}
+	}
+
+	result = withSources(result, items)
+
+	if len(failed) > 0 {
+		sort.Ints(failed)
+		return &result, stale, &BatchError{Positions: failed, Err: failedErr}
+	}
+
+	return &result, stale, nil
+}
+
+// cleanChunk sends the chunk upstream and fills result, falling back to
+// the stale copies of the items when the call fails. It returns whether
+// stale copies were used and the items left without a value, together
+// with the upstream error. A cancelled request fails the whole chunk.
+func (s ProxyService) cleanChunk(ctx context.Context, path string, chunk []*batchItem, result dadata.DaDataClean, logger *slog.Logger) (bool, []*batchItem, error) {
+	policy := s.policy(path)
+	endpoint := s.usageEndpoint(ctx, path)
+
+	queries := make([]json.RawMessage, len(chunk))
+	for index, item := range chunk {
+		queries[index] = item.raw
+	}
+
+	body, err := json.Marshal(queries)
+	if err != nil {
+		return false, nil, err
+	}
+
+	value, shared, err := s.inflight.do(ctx, s.makeKey(path, string(body)), func(ctx context.Context) (interface{}, error) {
+		// The cleaner bills every item, as if each were a single request.
+		s.usage.calls(endpoint, len(chunk))
+		return s.dadata.GetCleanValue(ctx, path, string(body))
+	})
+	var cleaned dadata.DaDataClean
+	if err == nil {
+		if res := value.(*dadata.DaDataClean); res != nil {
+			cleaned = *res
+		}
+		if len(cleaned) != len(chunk) {
+			err = fmt.Errorf("%w: sent %d, got %d", ErrBatchMismatch, len(chunk), len(cleaned))
+		}
+	}
+	if err != nil {
+		logger.Error("Get batch from dadata api", slog.String("error", err.Error()))
+
+		if ctx.Err() != nil {
+			return false, nil, err
+		}
+
+		var (
+			stale  bool
+			failed []*batchItem
+		)
+		for _, item := range chunk {
+			staleValue, ok := s.readFallback(ctx, item.key, policy, err, logger)
+
+			var staleItem dadata.DaDataClean
+			if !ok || json.Unmarshal([]byte(staleValue), &staleItem) != nil || len(staleItem) != 1 {
+				failed = append(failed, item)
+				continue
+			}
+
+			item.fill(result, staleItem[0])
+			stale = true
+		}
+
+		if len(failed) == 0 {
+			return stale, nil, nil
+		}
+
+		return stale, failed, err
+	}
+
+	for index, item := range chunk {
+		item.fill(result, cleaned[index])
+
+		if shared || policy.Disabled {
+			continue
+		}
+
+		encodingResult, _ := json.Marshal(dadata.DaDataClean{cleaned[index]})
+		go s.saveResult(context.WithoutCancel(ctx), item.key, encodingResult, policy)
+	}
+
+	return false, nil, nil
+}
+
+// readBatchItem reads an item saved either by a batch or by a single item
+// request; both store a one element array.
+func (s ProxyService) readBatchItem(ctx context.Context, key string) (map[string]interface{}, bool) {
+	value, err := s.storage.Read(ctx, key)
+	if err != nil || value == nil {
+		return nil, false
+	}
+
+	var cleaned dadata.DaDataClean
+	if json.Unmarshal([]byte(value.(string)), &cleaned) != nil || len(cleaned) != 1 {
+		return nil, false
+	}
+
+	return cleaned[0], true
+}
+
+func (item *batchItem) fill(result dadata.DaDataClean, value map[string]interface{}) {
+	for _, position := range item.positions {
+		result[position] = value
+	}
+}
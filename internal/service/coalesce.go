@@ -0,0 +1,90 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+type flightCall struct {
+	done    chan struct{}
+	value   interface{}
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// flightGroup collapses concurrent calls with the same key into one,
+// so identical upstream requests are made (and billed) only once.
+type flightGroup struct {
+	mu        sync.Mutex
+	calls     map[string]*flightCall
+	collapsed atomic.Uint64
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{
+		calls: make(map[string]*flightCall),
+	}
+}
+
+// do runs fn once per key at a time. Callers that arrive while fn is
+// running wait for it and get its result with shared set to true.
+// fn is cancelled only when every waiting caller's context is done.
+func (g *flightGroup) do(ctx context.Context, key string, fn func(context.Context) (interface{}, error)) (interface{}, bool, error) {
+	g.mu.Lock()
+	if call, ok := g.calls[key]; ok {
+		call.waiters++
+		g.mu.Unlock()
+		g.collapsed.Add(1)
+
+		return g.wait(ctx, key, call, true)
+	}
+
+	callCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	call := &flightCall{
+		done:    make(chan struct{}),
+		waiters: 1,
+		cancel:  cancel,
+	}
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	go func() {
+		call.value, call.err = fn(callCtx)
+
+		g.mu.Lock()
+		if g.calls[key] == call {
+			delete(g.calls, key)
+		}
+		g.mu.Unlock()
+
+		cancel()
+		close(call.done)
+	}()
+
+	return g.wait(ctx, key, call, false)
+}
+
+func (g *flightGroup) wait(ctx context.Context, key string, call *flightCall, shared bool) (interface{}, bool, error) {
+	select {
+	case <-call.done:
+		return call.value, shared, call.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			if g.calls[key] == call {
+				delete(g.calls, key)
+			}
+			call.cancel()
+		}
+		g.mu.Unlock()
+
+		return nil, shared, ctx.Err()
+	}
+}
+
+func (g *flightGroup) Collapsed() uint64 {
+	return g.collapsed.Load()
+}
@@ -0,0 +1,151 @@
+package dadata
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/ilazutin/dadataproxy_go/internal/config"
+)
+
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"
+	BreakerOpen     BreakerState = "open"
+	BreakerHalfOpen BreakerState = "half-open"
+)
+
+type BreakerStatus struct {
+	Name     string       `json:"name"`
+	State    BreakerState `json:"state"`
+	Failures int          `json:"failures"`
+	OpenedAt *time.Time   `json:"opened_at,omitempty"`
+}
+
+// breaker is a circuit breaker for one DaData host. It opens after
+// FailureThreshold consecutive upstream failures, fails fast for
+// OpenTimeout, then lets HalfOpenRequests probes through to decide
+// whether to close again.
+type breaker struct {
+	name     string
+	config   config.CircuitBreaker
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probes   int
+	logger   *slog.Logger
+}
+
+func newBreaker(name string, cfg config.CircuitBreaker, logger *slog.Logger) *breaker {
+	return &breaker{
+		name:   name,
+		config: cfg,
+		state:  BreakerClosed,
+		logger: logger,
+	}
+}
+
+// do runs call unless the breaker is open. ctx is the caller's context,
+// not the one of the attempt: an attempt cut off by its deadline while
+// the caller still waits is an upstream failure.
+func (b *breaker) do(ctx context.Context, call func() error) error {
+	if b.config.FailureThreshold <= 0 {
+		return call()
+	}
+
+	if err := b.allow(); err != nil {
+		return err
+	}
+
+	err := call()
+	b.done(ctx, err)
+
+	return err
+}
+
+func (b *breaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen {
+		if time.Since(b.openedAt) < b.config.OpenTimeout {
+			return &Error{Kind: ErrCircuitOpen}
+		}
+		b.setState(BreakerHalfOpen)
+	}
+
+	if b.state == BreakerHalfOpen {
+		if b.probes >= max(b.config.HalfOpenRequests, 1) {
+			return &Error{Kind: ErrCircuitOpen}
+		}
+		b.probes++
+	}
+
+	return nil
+}
+
+func (b *breaker) done(ctx context.Context, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// A call the caller gave up on or a locally rate limited call says
+	// nothing about upstream health.
+	if ctx.Err() != nil || errors.Is(err, context.Canceled) || errors.Is(err, ErrRateLimited) {
+		if b.state == BreakerHalfOpen && b.probes > 0 {
+			b.probes--
+		}
+		return
+	}
+
+	// A client or attempt timeout is a hung upstream.
+	if !errors.Is(err, ErrUpstreamUnavailable) && !errors.Is(err, context.DeadlineExceeded) {
+		b.failures = 0
+		if b.state == BreakerHalfOpen {
+			b.setState(BreakerClosed)
+		}
+		return
+	}
+
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.config.FailureThreshold {
+		b.openedAt = time.Now()
+		b.setState(BreakerOpen)
+	}
+}
+
+func (b *breaker) setState(state BreakerState) {
+	if b.state == state {
+		return
+	}
+
+	b.logger.Warn("Circuit breaker state changed",
+		slog.String("breaker", b.name),
+		slog.String("from", string(b.state)),
+		slog.String("to", string(state)),
+		slog.Int("failures", b.failures),
+	)
+
+	b.state = state
+	b.probes = 0
+}
+
+func (b *breaker) Status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	status := BreakerStatus{
+		Name:     b.name,
+		State:    b.state,
+		Failures: b.failures,
+	}
+	if b.state != BreakerClosed {
+		openedAt := b.openedAt
+		status.OpenedAt = &openedAt
+	}
+
+	return status
+}
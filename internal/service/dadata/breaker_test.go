@@ -0,0 +1,109 @@
+package dadata
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/ilazutin/dadataproxy_go/internal/config"
+)
+
+type BreakerTestSuite struct {
+	suite.Suite
+}
+
+func (suite *BreakerTestSuite) TestOpensAndRecovers() {
+	transport := &sequenceTransport{statuses: []int{
+		http.StatusServiceUnavailable,
+		http.StatusServiceUnavailable,
+		http.StatusOK,
+	}}
+
+	client, err := New(config.DaData{
+		Token:      "token",
+		SuggestUrl: "http://suggestions.local/api",
+		Breaker: config.CircuitBreaker{
+			FailureThreshold: 2,
+			OpenTimeout:      20 * time.Millisecond,
+			HalfOpenRequests: 1,
+		},
+	}, transport, slog.New(slog.NewTextHandler(os.Stdout, nil)))
+	suite.Require().NoError(err)
+
+	for i := 0; i < 2; i++ {
+		_, err = client.GetSuggestValue(context.Background(), "/suggest/address", `{"query":"мск"}`)
+		suite.ErrorIs(err, ErrUpstreamUnavailable)
+	}
+
+	_, err = client.GetSuggestValue(context.Background(), "/suggest/address", `{"query":"мск"}`)
+	suite.ErrorIs(err, ErrCircuitOpen)
+	suite.Equal(int32(2), transport.calls.Load())
+	suite.Equal(BreakerOpen, client.Breakers()[1].State)
+	suite.Equal(BreakerClosed, client.Breakers()[0].State)
+
+	time.Sleep(30 * time.Millisecond)
+
+	_, err = client.GetSuggestValue(context.Background(), "/suggest/address", `{"query":"мск"}`)
+	suite.NoError(err)
+	suite.Equal(BreakerClosed, client.Breakers()[1].State)
+}
+
+func (suite *BreakerTestSuite) TestOpensOnSlowUpstream() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(200 * time.Millisecond):
+		}
+		w.Write([]byte(`{"suggestions":[]}`)) //nolint:errcheck
+	}))
+	defer server.Close()
+
+	breaker := config.CircuitBreaker{FailureThreshold: 2, OpenTimeout: time.Minute, HalfOpenRequests: 1}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	client, err := New(config.DaData{
+		Token:      "token",
+		SuggestUrl: server.URL,
+		Timeout:    50 * time.Millisecond,
+		Breaker:    breaker,
+	}, http.DefaultTransport, logger)
+	suite.Require().NoError(err)
+
+	for i := 0; i < 2; i++ {
+		_, err = client.GetSuggestValue(context.Background(), "/suggest/address", `{"query":"мск"}`)
+		suite.ErrorIs(err, ErrUpstreamUnavailable)
+	}
+	suite.Equal(BreakerOpen, client.Breakers()[1].State, "client timeouts open the breaker")
+
+	transport := &hangingTransport{}
+	client, err = New(config.DaData{
+		Token:      "token",
+		SuggestUrl: "http://suggestions.local/api",
+		Retry:      config.DaDataRetry{Suggest: config.RetryPolicy{MaxAttempts: 1, Deadline: 20 * time.Millisecond}},
+		Breaker:    breaker,
+	}, transport, logger)
+	suite.Require().NoError(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = client.GetSuggestValue(ctx, "/suggest/address", `{"query":"мск"}`)
+	suite.ErrorIs(err, context.Canceled)
+	suite.Zero(client.Breakers()[1].Failures, "a cancelled caller is not a failure")
+
+	for i := 0; i < 2; i++ {
+		_, err = client.GetSuggestValue(context.Background(), "/suggest/address", `{"query":"мск"}`)
+		suite.ErrorIs(err, ErrUpstreamUnavailable)
+	}
+	suite.Equal(BreakerOpen, client.Breakers()[1].State, "attempt deadlines open the breaker")
+}
+
+func TestBreakerTestSuite(t *testing.T) {
+	t.Parallel()
+	suite.Run(t, new(BreakerTestSuite))
+}
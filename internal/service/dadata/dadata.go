@@ -1,23 +1,49 @@
 package dadata
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"strings"
+
+	"github.com/ilazutin/dadataproxy_go/internal/config"
 )
 
 const (
-	cleanUrl   = "https://cleaner.dadata.ru/api/v1"
-	suggestUrl = "https://suggestions.dadata.ru/suggestions/api/4_1/rs"
+	HostClean   = "clean"
+	HostSuggest = "suggest"
+	HostProfile = "profile"
+)
+
+var (
+	ErrUnknownHost = errors.New("unknown dadata host")
 )
 
 type DaData struct {
 	client    *http.Client
-	token     string
-	secretKey string
+	clean     api
+	suggest   api
+	profile   api
+	limitMode string
+	keys      *keyPool
+}
+
+// api holds per-host settings of one DaData API family.
+type api struct {
+	name    string
+	url     string
+	secret  bool
+	billed  bool
+	retry   config.RetryPolicy
+	breaker *breaker
+	// limiters hold the request budget of every key, as DaData limits
+	// each token on its own.
+	limiters map[*credential]*limiter
 }
 
 type DaDataClean []map[string]interface{}
@@ -30,51 +56,68 @@ type DaDataIpLocate struct {
 	Location map[string]interface{} `json:"location"`
 }
 
-func New(token string, secretKey string) *DaData {
-	return &DaData{
-		client: &http.Client{
-			Transport: http.DefaultTransport,
-		},
-		token:     token,
-		secretKey: secretKey,
-	}
+type DaDataBalance struct {
+	Balance float64 `json:"balance"`
 }
 
-func (d *DaData) GetCleanValue(path string, body string) (*DaDataClean, error) {
-	req, err := http.NewRequest("POST", cleanUrl+path, strings.NewReader(body))
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Set("Authorization", "Token "+d.token)
-	req.Header.Set("X-Secret", d.secretKey)
-	req.Header.Set("Content-Type", "application/json")
+type DaDataDailyStats struct {
+	Date     string         `json:"date"`
+	Services map[string]int `json:"services"`
+}
 
-	response, err := d.client.Do(req)
+// New creates a DaData client. When transport is nil it is built from
+// cfg (proxy, TLS and connection pool settings).
+func New(cfg config.DaData, transport http.RoundTripper, logger *slog.Logger) (*DaData, error) {
+	keys, err := newKeyPool(cfg, logger)
 	if err != nil {
 		return nil, err
 	}
 
-	if response.StatusCode == 429 {
-		return nil, errors.New("query limit reached, come back after midnight") //TODO move to const
-	}
-
-	if response.StatusCode != 200 {
-		rBytes, err := io.ReadAll(response.Body)
+	if transport == nil {
+		configured, err := newTransport(cfg)
 		if err != nil {
 			return nil, err
 		}
-
-		return nil, fmt.Errorf("cannot get value from dadata api with error: %s", string(rBytes))
+		transport = configured
 	}
 
-	rBytes, err := io.ReadAll(response.Body)
-	if err != nil {
-		return nil, err
-	}
+	return &DaData{
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   cfg.Timeout,
+		},
+		clean: api{
+			name:     "cleaner",
+			url:      strings.TrimSuffix(cfg.CleanUrl, "/"),
+			secret:   true,
+			billed:   true,
+			retry:    cfg.Retry.Clean,
+			breaker:  newBreaker("cleaner", cfg.Breaker, logger),
+			limiters: newLimiters("cleaner", cfg.RateLimit.Mode, cfg.RateLimit.Clean, keys),
+		},
+		suggest: api{
+			name:     "suggestions",
+			url:      strings.TrimSuffix(cfg.SuggestUrl, "/"),
+			retry:    cfg.Retry.Suggest,
+			breaker:  newBreaker("suggestions", cfg.Breaker, logger),
+			limiters: newLimiters("suggestions", cfg.RateLimit.Mode, cfg.RateLimit.Suggest, keys),
+		},
+		profile: api{
+			name:     "profile",
+			url:      strings.TrimSuffix(cfg.ProfileUrl, "/"),
+			secret:   true,
+			retry:    cfg.Retry.Suggest,
+			breaker:  newBreaker("profile", cfg.Breaker, logger),
+			limiters: newLimiters("profile", cfg.RateLimit.Mode, config.RateBudget{}, keys),
+		},
+		limitMode: cfg.RateLimit.Mode,
+		keys:      keys,
+	}, nil
+}
 
+func (d *DaData) GetCleanValue(ctx context.Context, path string, body string) (*DaDataClean, error) {
 	var res *DaDataClean
-	err = json.Unmarshal(rBytes, &res)
+	err := d.call(ctx, d.clean, http.MethodPost, path, body, &res)
 	if err != nil {
 		return nil, err
 	}
@@ -82,40 +125,74 @@ func (d *DaData) GetCleanValue(path string, body string) (*DaDataClean, error) {
 	return res, nil
 }
 
-func (d *DaData) GetSuggestValue(path string, body string) (*DaDataSuggest, error) {
-	req, err := http.NewRequest("POST", suggestUrl+path, strings.NewReader(body))
+func (d *DaData) GetSuggestValue(ctx context.Context, path string, body string) (*DaDataSuggest, error) {
+	var res DaDataSuggest
+	err := d.call(ctx, d.suggest, http.MethodPost, path, body, &res)
 	if err != nil {
 		return nil, err
 	}
 
-	req.Header.Set("Authorization", "Token "+d.token)
-	req.Header.Set("Content-Type", "application/json")
+	return &res, nil
+}
 
-	response, err := d.client.Do(req)
+func (d *DaData) GetIpLocateValue(ctx context.Context, path string, body string) (*DaDataIpLocate, error) {
+	var res DaDataIpLocate
+	err := d.call(ctx, d.suggest, http.MethodPost, path, body, &res)
 	if err != nil {
 		return nil, err
 	}
 
-	if response.StatusCode == 429 {
-		return nil, errors.New("query limit reached, come back after midnight") //TODO move to const
+	return &res, nil
+}
+
+func (d *DaData) GetBalance(ctx context.Context) (*DaDataBalance, error) {
+	var res DaDataBalance
+	err := d.call(ctx, d.profile, http.MethodGet, "/profile/balance", "", &res)
+	if err != nil {
+		return nil, err
 	}
 
-	if response.StatusCode != 200 {
-		rBytes, err := io.ReadAll(response.Body)
-		if err != nil {
-			return nil, err
-		}
+	return &res, nil
+}
 
-		return nil, fmt.Errorf("cannot get value from dadata api with error: %s", string(rBytes))
+// GetDailyStats returns the usage by service for date (YYYY-MM-DD), or
+// for today when date is empty.
+func (d *DaData) GetDailyStats(ctx context.Context, date string) (*DaDataDailyStats, error) {
+	path := "/stat/daily"
+	if date != "" {
+		path += "?" + url.Values{"date": {date}}.Encode()
 	}
 
-	rBytes, err := io.ReadAll(response.Body)
+	var res DaDataDailyStats
+	err := d.call(ctx, d.profile, http.MethodGet, path, "", &res)
 	if err != nil {
 		return nil, err
 	}
 
-	var res DaDataSuggest
-	err = json.Unmarshal(rBytes, &res)
+	return &res, nil
+}
+
+// Forward sends a request to any endpoint of the given host and returns
+// the raw JSON response.
+func (d *DaData) Forward(ctx context.Context, host string, method string, path string, rawQuery string, body string) (*json.RawMessage, error) {
+	var a api
+	switch host {
+	case HostClean:
+		a = d.clean
+	case HostSuggest:
+		a = d.suggest
+	case HostProfile:
+		a = d.profile
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownHost, host)
+	}
+
+	if rawQuery != "" {
+		path += "?" + rawQuery
+	}
+
+	var res json.RawMessage
+	err := d.call(ctx, a, method, path, body, &res)
 	if err != nil {
 		return nil, err
 	}
@@ -123,43 +200,122 @@ func (d *DaData) GetSuggestValue(path string, body string) (*DaDataSuggest, erro
 	return &res, nil
 }
 
-func (d *DaData) GetIpLocateValue(path string, body string) (*DaDataIpLocate, error) {
-	req, err := http.NewRequest("POST", suggestUrl+path, strings.NewReader(body))
-	if err != nil {
-		return nil, err
+func (d *DaData) Breakers() []BreakerStatus {
+	return []BreakerStatus{
+		d.clean.breaker.Status(),
+		d.suggest.breaker.Status(),
+		d.profile.breaker.Status(),
 	}
+}
 
-	req.Header.Set("Authorization", "Token "+d.token)
-	req.Header.Set("Content-Type", "application/json")
+func (d *DaData) Keys() []KeyStatus {
+	return d.keys.Status()
+}
 
-	response, err := d.client.Do(req)
+// Limits returns the request budget of every key for the cleaner and
+// the suggestions API.
+func (d *DaData) Limits() []LimitStatus {
+	var statuses []LimitStatus
+	for _, a := range []api{d.clean, d.suggest} {
+		for _, key := range d.keys.keys {
+			status := a.limiters[key].Status()
+			status.Key = key.name
+			statuses = append(statuses, status)
+		}
+	}
+
+	return statuses
+}
+
+// CacheOnlyWhenLimited reports whether rate limited requests may be
+// answered from the stale cache instead of failing.
+func (d *DaData) CacheOnlyWhenLimited() bool {
+	return d.limitMode == LimitModeCache
+}
+
+func (d *DaData) call(ctx context.Context, a api, method string, path string, body string, result interface{}) error {
+	return withRetry(ctx, a.retry, a.billed, func(attemptCtx context.Context) error {
+		return a.breaker.do(ctx, func() error {
+			return d.sendWithFailover(attemptCtx, a, method, a.url+path, body, result)
+		})
+	})
+}
+
+// sendWithFailover sends the request with the next key that has quota
+// and request budget left for the API family, and repeats a request
+// rejected for quota with the next key.
+func (d *DaData) sendWithFailover(ctx context.Context, a api, method string, url string, body string, result interface{}) error {
+	var err error
+	for attempt := 0; attempt < d.keys.size(); attempt++ {
+		key, pickErr := d.keys.pick(a.name)
+		if pickErr != nil {
+			if err == nil {
+				err = pickErr
+			}
+			return err
+		}
+
+		if err = a.limiters[key].take(ctx); err != nil {
+			if errors.Is(err, ErrRateLimited) {
+				continue
+			}
+			// Queueing for a token past the attempt deadline is a local
+			// limit, not an upstream failure.
+			return &Error{Kind: ErrRateLimited, Err: err}
+		}
+
+		err = d.send(ctx, method, url, body, key, a.secret, result)
+		d.keys.report(key, a.name, err)
+		if !exhausted(err) {
+			return err
+		}
+	}
+
+	return err
+}
+
+func (d *DaData) send(ctx context.Context, method string, url string, body string, key *credential, withSecret bool, result interface{}) error {
+	var reader io.Reader = http.NoBody
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	if response.StatusCode == 429 {
-		return nil, errors.New("query limit reached, come back after midnight") //TODO move to const
+	req.Header.Set("Authorization", "Token "+key.token)
+	if withSecret {
+		req.Header.Set("X-Secret", key.secret)
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
 	}
 
-	if response.StatusCode != 200 {
-		rBytes, err := io.ReadAll(response.Body)
-		if err != nil {
-			return nil, err
+	response, err := d.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
-
-		return nil, fmt.Errorf("cannot get value from dadata api with error: %s", string(rBytes))
+		return &Error{Kind: ErrUpstreamUnavailable, Err: err}
 	}
+	defer response.Body.Close()
 
 	rBytes, err := io.ReadAll(response.Body)
 	if err != nil {
-		return nil, err
+		return &Error{Kind: ErrUpstreamUnavailable, StatusCode: response.StatusCode, Err: err}
 	}
 
-	var res DaDataIpLocate
-	err = json.Unmarshal(rBytes, &res)
+	if response.StatusCode != http.StatusOK {
+		return statusError(response.StatusCode, string(rBytes))
+	}
+
+	err = json.Unmarshal(rBytes, result)
 	if err != nil {
-		return nil, err
+		return &Error{Kind: ErrDecode, StatusCode: response.StatusCode, Body: string(rBytes), Err: err}
 	}
 
-	return &res, nil
+	return nil
 }
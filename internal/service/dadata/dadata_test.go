@@ -0,0 +1,82 @@
+package dadata
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/ilazutin/dadataproxy_go/internal/config"
+)
+
+// recordTransport keeps the last request and answers with body.
+type recordTransport struct {
+	body    string
+	request *http.Request
+}
+
+func (t *recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.request = req
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader(t.body)),
+		Request:    req,
+	}, nil
+}
+
+type DaDataTestSuite struct {
+	suite.Suite
+
+	transport *recordTransport
+	client    *DaData
+}
+
+func (suite *DaDataTestSuite) SetupTest() {
+	suite.transport = &recordTransport{body: `{"balance":9922.30}`}
+
+	client, err := New(config.DaData{
+		Token:      "token",
+		SecretKey:  "secret",
+		ProfileUrl: "https://dadata.local/api/v2/",
+	}, suite.transport, slog.New(slog.NewTextHandler(os.Stdout, nil)))
+	suite.Require().NoError(err)
+
+	suite.client = client
+}
+
+func (suite *DaDataTestSuite) TestForward() {
+	result, err := suite.client.Forward(context.Background(), HostProfile, http.MethodGet, "/stat/daily", "date=2024-01-31", "")
+	suite.Require().NoError(err)
+	suite.JSONEq(`{"balance":9922.30}`, string(*result))
+
+	req := suite.transport.request
+	suite.Equal(http.MethodGet, req.Method)
+	suite.Equal("https://dadata.local/api/v2/stat/daily?date=2024-01-31", req.URL.String())
+	suite.Equal("secret", req.Header.Get("X-Secret"))
+	suite.Empty(req.Header.Get("Content-Type"))
+}
+
+func (suite *DaDataTestSuite) TestForwardUnknownHost() {
+	_, err := suite.client.Forward(context.Background(), "billing", http.MethodGet, "/balance", "", "")
+	suite.ErrorIs(err, ErrUnknownHost)
+}
+
+func (suite *DaDataTestSuite) TestGetDailyStats() {
+	suite.transport.body = `{"date":"2024-01-31","services":{"clean":1004,"suggestions":11}}`
+
+	stats, err := suite.client.GetDailyStats(context.Background(), "2024-01-31")
+	suite.Require().NoError(err)
+	suite.Equal(1004, stats.Services["clean"])
+	suite.Equal("https://dadata.local/api/v2/stat/daily?date=2024-01-31", suite.transport.request.URL.String())
+}
+
+func TestDaDataTestSuite(t *testing.T) {
+	t.Parallel()
+	suite.Run(t, new(DaDataTestSuite))
+}
@@ -0,0 +1,81 @@
+package dadata
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var (
+	ErrQuotaExceeded       = errors.New("query limit reached, come back after midnight")
+	ErrBadRequest          = errors.New("bad request")
+	ErrUnauthorized        = errors.New("unauthorized")
+	ErrForbidden           = errors.New("forbidden, the daily limit or the balance of the key is exhausted")
+	ErrUpstreamUnavailable = errors.New("upstream unavailable")
+	ErrDecode              = errors.New("cannot decode dadata response")
+	ErrCircuitOpen         = errors.New("dadata api is unavailable, circuit breaker is open")
+	ErrRateLimited         = errors.New("dadata request budget is exhausted")
+)
+
+var errorCodes = map[error]string{
+	ErrQuotaExceeded:       "quota_exceeded",
+	ErrBadRequest:          "bad_request",
+	ErrUnauthorized:        "unauthorized",
+	ErrForbidden:           "forbidden",
+	ErrUpstreamUnavailable: "upstream_unavailable",
+	ErrDecode:              "decode_error",
+	ErrCircuitOpen:         "circuit_open",
+	ErrRateLimited:         "rate_limited",
+}
+
+// Error is returned by DaData methods for every failed upstream call.
+// Kind is one of the Err* values and can be checked with errors.Is.
+type Error struct {
+	Kind       error
+	StatusCode int
+	Body       string
+	Err        error
+}
+
+func (e *Error) Error() string {
+	switch {
+	case e.StatusCode == 0 && e.Err == nil:
+		return e.Kind.Error()
+	case e.Err != nil:
+		return fmt.Sprintf("%s: %s", e.Kind, e.Err)
+	case e.Body != "":
+		return fmt.Sprintf("%s: dadata api responded %d: %s", e.Kind, e.StatusCode, e.Body)
+	default:
+		return fmt.Sprintf("%s: dadata api responded %d", e.Kind, e.StatusCode)
+	}
+}
+
+func (e *Error) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Kind}
+	}
+
+	return []error{e.Kind, e.Err}
+}
+
+func (e *Error) Code() string {
+	return errorCodes[e.Kind]
+}
+
+func statusError(statusCode int, body string) *Error {
+	var kind error
+	switch {
+	case statusCode == http.StatusTooManyRequests:
+		kind = ErrQuotaExceeded
+	case statusCode == http.StatusUnauthorized:
+		kind = ErrUnauthorized
+	case statusCode == http.StatusForbidden:
+		kind = ErrForbidden
+	case statusCode >= http.StatusInternalServerError:
+		kind = ErrUpstreamUnavailable
+	default:
+		kind = ErrBadRequest
+	}
+
+	return &Error{Kind: kind, StatusCode: statusCode, Body: body}
+}
@@ -0,0 +1,46 @@
+package dadata
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ErrorsTestSuite struct {
+	suite.Suite
+}
+
+func (suite *ErrorsTestSuite) TestStatusError() {
+	cases := map[int]error{
+		http.StatusTooManyRequests:       ErrQuotaExceeded,
+		http.StatusBadRequest:            ErrBadRequest,
+		http.StatusUnauthorized:          ErrUnauthorized,
+		http.StatusForbidden:             ErrForbidden,
+		http.StatusBadGateway:            ErrUpstreamUnavailable,
+		http.StatusServiceUnavailable:    ErrUpstreamUnavailable,
+		http.StatusRequestEntityTooLarge: ErrBadRequest,
+	}
+
+	for status, kind := range cases {
+		err := statusError(status, "body")
+		suite.ErrorIs(err, kind, "status %d", status)
+		suite.Equal(status, err.StatusCode)
+		suite.Equal("body", err.Body)
+	}
+}
+
+func (suite *ErrorsTestSuite) TestUnwrapCause() {
+	cause := errors.New("connection reset")
+	err := &Error{Kind: ErrUpstreamUnavailable, Err: cause}
+
+	suite.ErrorIs(err, ErrUpstreamUnavailable)
+	suite.ErrorIs(err, cause)
+	suite.Equal("upstream_unavailable", err.Code())
+}
+
+func TestErrorsTestSuite(t *testing.T) {
+	t.Parallel()
+	suite.Run(t, new(ErrorsTestSuite))
+}
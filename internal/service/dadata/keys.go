@@ -0,0 +1,195 @@
+package dadata
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/ilazutin/dadataproxy_go/internal/config"
+)
+
+const (
+	KeySelectionRoundRobin = "round_robin"
+	KeySelectionWeighted   = "weighted"
+)
+
+var (
+	ErrNoCredentials = errors.New("no dadata credentials configured")
+)
+
+type KeyStatus struct {
+	Name          string               `json:"name"`
+	Weight        int                  `json:"weight"`
+	Requests      uint64               `json:"requests"`
+	Failures      uint64               `json:"failures"`
+	LastError     string               `json:"last_error,omitempty"`
+	DisabledUntil map[string]time.Time `json:"disabled_until,omitempty"`
+}
+
+type credential struct {
+	name          string
+	token         string
+	secret        string
+	weight        int
+	currentWeight int
+	requests      uint64
+	failures      uint64
+	lastError     string
+	disabledUntil map[string]time.Time
+}
+
+// keyPool hands out DaData credentials in round-robin or smooth
+// weighted round-robin order. A key whose quota of an API family is
+// exhausted (429, or 403 which the suggestions API answers once the
+// daily limit of a token is used up) is skipped for that family until
+// the quota resets at the next Moscow midnight. An invalid key (401)
+// fails the request only and is never disabled.
+type keyPool struct {
+	mu       sync.Mutex
+	keys     []*credential
+	weighted bool
+	next     int
+	logger   *slog.Logger
+}
+
+func newKeyPool(cfg config.DaData, logger *slog.Logger) (*keyPool, error) {
+	credentials := cfg.Credentials
+	if len(credentials) == 0 && cfg.Token != "" {
+		credentials = []config.Credential{{Token: cfg.Token, Secret: cfg.SecretKey}}
+	}
+	if len(credentials) == 0 {
+		return nil, ErrNoCredentials
+	}
+
+	keys := make([]*credential, 0, len(credentials))
+	for index, c := range credentials {
+		name := c.Name
+		if name == "" {
+			name = fmt.Sprintf("key-%d", index+1)
+		}
+
+		keys = append(keys, &credential{
+			name:          name,
+			token:         c.Token,
+			secret:        c.Secret,
+			weight:        max(c.Weight, 1),
+			disabledUntil: map[string]time.Time{},
+		})
+	}
+
+	return &keyPool{
+		keys:     keys,
+		weighted: cfg.KeySelection == KeySelectionWeighted,
+		logger:   logger,
+	}, nil
+}
+
+func (p *keyPool) size() int {
+	return len(p.keys)
+}
+
+// pick returns the next key with quota left for the API family.
+func (p *keyPool) pick(family string) (*credential, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+
+	if p.weighted {
+		var (
+			best  *credential
+			total int
+		)
+		for _, key := range p.keys {
+			if key.disabled(family, now) {
+				continue
+			}
+			key.currentWeight += key.weight
+			total += key.weight
+			if best == nil || key.currentWeight > best.currentWeight {
+				best = key
+			}
+		}
+		if best == nil {
+			return nil, &Error{Kind: ErrQuotaExceeded}
+		}
+		best.currentWeight -= total
+		best.requests++
+
+		return best, nil
+	}
+
+	for i := 0; i < len(p.keys); i++ {
+		key := p.keys[(p.next+i)%len(p.keys)]
+		if key.disabled(family, now) {
+			continue
+		}
+		p.next = (p.next + i + 1) % len(p.keys)
+		key.requests++
+
+		return key, nil
+	}
+
+	return nil, &Error{Kind: ErrQuotaExceeded}
+}
+
+func (p *keyPool) report(key *credential, family string, err error) {
+	if err == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key.failures++
+	key.lastError = err.Error()
+
+	if exhausted(err) {
+		key.disabledUntil[family] = startOfDay(time.Now()).AddDate(0, 0, 1)
+		p.logger.Warn("DaData key disabled until quota reset",
+			slog.String("key", key.name),
+			slog.String("api", family),
+			slog.String("until", key.disabledUntil[family].String()),
+			slog.String("error", err.Error()),
+		)
+	}
+}
+
+func (p *keyPool) Status() []KeyStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	statuses := make([]KeyStatus, 0, len(p.keys))
+	for _, key := range p.keys {
+		status := KeyStatus{
+			Name:      key.name,
+			Weight:    key.weight,
+			Requests:  key.requests,
+			Failures:  key.failures,
+			LastError: key.lastError,
+		}
+		for family, until := range key.disabledUntil {
+			if key.disabled(family, now) {
+				if status.DisabledUntil == nil {
+					status.DisabledUntil = map[string]time.Time{}
+				}
+				status.DisabledUntil[family] = until
+			}
+		}
+		statuses = append(statuses, status)
+	}
+
+	return statuses
+}
+
+// exhausted reports whether err means the key has no quota left.
+func exhausted(err error) bool {
+	return errors.Is(err, ErrQuotaExceeded) || errors.Is(err, ErrForbidden)
+}
+
+func (c *credential) disabled(family string, now time.Time) bool {
+	return now.Before(c.disabledUntil[family])
+}
@@ -0,0 +1,227 @@
+package dadata
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/ilazutin/dadataproxy_go/internal/config"
+)
+
+// tokenTransport answers 429 for exhausted tokens (only on hosts
+// containing exhaustedHost when it is set), 403 for forbidden ones, 401
+// for unauthorized ones and records which tokens were used.
+type tokenTransport struct {
+	mu            sync.Mutex
+	exhausted     map[string]bool
+	exhaustedHost string
+	forbidden     map[string]bool
+	unauthorized  map[string]bool
+	used          []string
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Token ")
+
+	t.mu.Lock()
+	t.used = append(t.used, token)
+	t.mu.Unlock()
+
+	status, body := http.StatusOK, `{"suggestions":[]}`
+	if strings.Contains(req.URL.Host, "cleaner") {
+		body = `[]`
+	}
+	switch {
+	case t.exhausted[token] && strings.Contains(req.URL.Host, t.exhaustedHost):
+		status, body = http.StatusTooManyRequests, `{"message":"limit"}`
+	case t.forbidden[token]:
+		status, body = http.StatusForbidden, `{"message":"daily limit"}`
+	case t.unauthorized[token]:
+		status, body = http.StatusUnauthorized, `{"message":"unauthorized"}`
+	}
+
+	return &http.Response{
+		StatusCode: status,
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+type KeyPoolTestSuite struct {
+	suite.Suite
+}
+
+func (suite *KeyPoolTestSuite) newClient(transport http.RoundTripper, selection string, credentials ...config.Credential) *DaData {
+	return suite.newLimitedClient(transport, selection, config.RateLimit{Mode: LimitModeQueue}, credentials...)
+}
+
+func (suite *KeyPoolTestSuite) newLimitedClient(transport http.RoundTripper, selection string, rateLimit config.RateLimit, credentials ...config.Credential) *DaData {
+	client, err := New(config.DaData{
+		CleanUrl:     "http://cleaner.local/api/v1",
+		SuggestUrl:   "http://suggestions.local/api",
+		Credentials:  credentials,
+		KeySelection: selection,
+		RateLimit:    rateLimit,
+	}, transport, slog.New(slog.NewTextHandler(os.Stdout, nil)))
+	suite.Require().NoError(err)
+
+	return client
+}
+
+func (suite *KeyPoolTestSuite) TestRoundRobin() {
+	transport := &tokenTransport{}
+	client := suite.newClient(transport, KeySelectionRoundRobin,
+		config.Credential{Token: "a"},
+		config.Credential{Token: "b"},
+	)
+
+	for i := 0; i < 4; i++ {
+		_, err := client.GetSuggestValue(context.Background(), "/suggest/address", `{"query":"мск"}`)
+		suite.Require().NoError(err)
+	}
+
+	suite.Equal([]string{"a", "b", "a", "b"}, transport.used)
+}
+
+func (suite *KeyPoolTestSuite) TestWeighted() {
+	transport := &tokenTransport{}
+	client := suite.newClient(transport, KeySelectionWeighted,
+		config.Credential{Token: "a", Weight: 3},
+		config.Credential{Token: "b", Weight: 1},
+	)
+
+	for i := 0; i < 8; i++ {
+		_, err := client.GetSuggestValue(context.Background(), "/suggest/address", `{"query":"мск"}`)
+		suite.Require().NoError(err)
+	}
+
+	counts := map[string]int{}
+	for _, token := range transport.used {
+		counts[token]++
+	}
+	suite.Equal(map[string]int{"a": 6, "b": 2}, counts)
+}
+
+func (suite *KeyPoolTestSuite) TestFailoverSkipsExhaustedKey() {
+	transport := &tokenTransport{exhausted: map[string]bool{"a": true}}
+	client := suite.newClient(transport, KeySelectionRoundRobin,
+		config.Credential{Name: "first", Token: "a"},
+		config.Credential{Name: "second", Token: "b"},
+	)
+
+	for i := 0; i < 3; i++ {
+		_, err := client.GetSuggestValue(context.Background(), "/suggest/address", `{"query":"мск"}`)
+		suite.Require().NoError(err)
+	}
+
+	suite.Equal([]string{"a", "b", "b", "b"}, transport.used)
+
+	statuses := client.Keys()
+	suite.Contains(statuses[0].DisabledUntil, "suggestions")
+	suite.Nil(statuses[1].DisabledUntil)
+	suite.Equal(uint64(3), statuses[1].Requests)
+}
+
+func (suite *KeyPoolTestSuite) TestAllKeysExhausted() {
+	transport := &tokenTransport{exhausted: map[string]bool{"a": true}}
+	client := suite.newClient(transport, KeySelectionRoundRobin, config.Credential{Token: "a"})
+
+	_, err := client.GetSuggestValue(context.Background(), "/suggest/address", `{"query":"мск"}`)
+	suite.ErrorIs(err, ErrQuotaExceeded)
+
+	_, err = client.GetSuggestValue(context.Background(), "/suggest/address", `{"query":"мск"}`)
+	suite.ErrorIs(err, ErrQuotaExceeded)
+	suite.Len(transport.used, 1)
+}
+
+func (suite *KeyPoolTestSuite) TestQuotaDisablesKeyPerFamily() {
+	transport := &tokenTransport{exhausted: map[string]bool{"a": true}, exhaustedHost: "suggestions"}
+	client := suite.newClient(transport, KeySelectionRoundRobin, config.Credential{Token: "a"})
+
+	_, err := client.GetSuggestValue(context.Background(), "/suggest/address", `{"query":"мск"}`)
+	suite.ErrorIs(err, ErrQuotaExceeded)
+
+	_, err = client.GetCleanValue(context.Background(), "/clean/address", `["мск"]`)
+	suite.Require().NoError(err)
+	suite.Equal([]string{"a", "a"}, transport.used)
+
+	disabled := client.Keys()[0].DisabledUntil
+	suite.Len(disabled, 1)
+	suite.Contains(disabled, "suggestions")
+}
+
+func (suite *KeyPoolTestSuite) TestUnauthorizedFailsOnlyTheRequest() {
+	transport := &tokenTransport{unauthorized: map[string]bool{"a": true}}
+	client := suite.newClient(transport, KeySelectionRoundRobin,
+		config.Credential{Token: "a"},
+		config.Credential{Token: "b"},
+	)
+
+	_, err := client.GetSuggestValue(context.Background(), "/suggest/address", `{"query":"мск"}`)
+	suite.ErrorIs(err, ErrUnauthorized)
+
+	for i := 0; i < 2; i++ {
+		_, err = client.GetSuggestValue(context.Background(), "/suggest/address", `{"query":"мск"}`)
+	}
+	suite.ErrorIs(err, ErrUnauthorized)
+	suite.Equal([]string{"a", "b", "a"}, transport.used)
+
+	for _, status := range client.Keys() {
+		suite.Nil(status.DisabledUntil, status.Name)
+	}
+}
+
+func (suite *KeyPoolTestSuite) TestForbiddenDisablesKeyPerFamily() {
+	transport := &tokenTransport{forbidden: map[string]bool{"a": true}}
+	client := suite.newClient(transport, KeySelectionRoundRobin,
+		config.Credential{Name: "first", Token: "a"},
+		config.Credential{Name: "second", Token: "b"},
+	)
+
+	for i := 0; i < 2; i++ {
+		_, err := client.GetSuggestValue(context.Background(), "/suggest/address", `{"query":"мск"}`)
+		suite.Require().NoError(err)
+	}
+
+	suite.Equal([]string{"a", "b", "b"}, transport.used)
+
+	disabled := client.Keys()[0].DisabledUntil
+	suite.Len(disabled, 1)
+	suite.Contains(disabled, "suggestions")
+}
+
+func (suite *KeyPoolTestSuite) TestBudgetPerKey() {
+	transport := &tokenTransport{}
+	client := suite.newLimitedClient(transport, KeySelectionRoundRobin,
+		config.RateLimit{Mode: LimitModeReject, Suggest: config.RateBudget{PerDay: 1}},
+		config.Credential{Name: "first", Token: "a"},
+		config.Credential{Name: "second", Token: "b"},
+	)
+
+	for i := 0; i < 2; i++ {
+		_, err := client.GetSuggestValue(context.Background(), "/suggest/address", `{"query":"мск"}`)
+		suite.Require().NoError(err)
+	}
+
+	_, err := client.GetSuggestValue(context.Background(), "/suggest/address", `{"query":"мск"}`)
+	suite.ErrorIs(err, ErrRateLimited)
+	suite.Equal([]string{"a", "b"}, transport.used)
+
+	limits := client.Limits()
+	suite.Require().Len(limits, 4)
+	suite.Equal(LimitStatus{Name: "suggestions", Key: "first", Mode: LimitModeReject, Used: 1, PerDay: 1, ResetsAt: limits[2].ResetsAt}, limits[2])
+	suite.Equal("second", limits[3].Key)
+	suite.Equal(int64(1), limits[3].Used)
+}
+
+func TestKeyPoolTestSuite(t *testing.T) {
+	t.Parallel()
+	suite.Run(t, new(KeyPoolTestSuite))
+}
@@ -0,0 +1,140 @@
+package dadata
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ilazutin/dadataproxy_go/internal/config"
+)
+
+const (
+	LimitModeQueue  = config.RateLimitQueue
+	LimitModeReject = config.RateLimitReject
+	LimitModeCache  = config.RateLimitCache
+)
+
+// DaData daily quotas reset at midnight Moscow time (UTC+3, no DST).
+var moscow = time.FixedZone("MSK", 3*60*60)
+
+type LimitStatus struct {
+	Name     string    `json:"name"`
+	Key      string    `json:"key"`
+	Mode     string    `json:"mode"`
+	Used     int64     `json:"used_today"`
+	PerDay   int64     `json:"per_day,omitempty"`
+	ResetsAt time.Time `json:"resets_at"`
+}
+
+// limiter is a token bucket with an additional daily request budget.
+// In queue mode callers wait for a token; in the other modes they get
+// ErrRateLimited at once. An exhausted daily budget is never queued.
+type limiter struct {
+	name   string
+	mode   string
+	budget config.RateBudget
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	day    time.Time
+	used   int64
+}
+
+func newLimiter(name string, mode string, budget config.RateBudget) *limiter {
+	return &limiter{
+		name:   name,
+		mode:   mode,
+		budget: budget,
+		tokens: float64(max(budget.Burst, 1)),
+	}
+}
+
+func newLimiters(name string, mode string, budget config.RateBudget, keys *keyPool) map[*credential]*limiter {
+	limiters := make(map[*credential]*limiter, keys.size())
+	for _, key := range keys.keys {
+		limiters[key] = newLimiter(name, mode, budget)
+	}
+
+	return limiters
+}
+
+func (l *limiter) take(ctx context.Context) error {
+	for {
+		wait, err := l.reserve(time.Now())
+		if err != nil {
+			return err
+		}
+		if wait == 0 {
+			return nil
+		}
+		if l.mode != LimitModeQueue {
+			return &Error{Kind: ErrRateLimited}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// reserve takes a token and counts the request, or returns how long to
+// wait for the next token.
+func (l *limiter) reserve(now time.Time) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if today := startOfDay(now); !today.Equal(l.day) {
+		l.day = today
+		l.used = 0
+	}
+
+	if l.budget.PerDay > 0 && l.used >= l.budget.PerDay {
+		return 0, &Error{Kind: ErrRateLimited}
+	}
+
+	if l.budget.PerSecond > 0 {
+		burst := float64(max(l.budget.Burst, 1))
+		if !l.last.IsZero() {
+			l.tokens = min(burst, l.tokens+now.Sub(l.last).Seconds()*l.budget.PerSecond)
+		}
+		l.last = now
+
+		if l.tokens < 1 {
+			return time.Duration((1 - l.tokens) / l.budget.PerSecond * float64(time.Second)), nil
+		}
+		l.tokens--
+	}
+
+	l.used++
+
+	return 0, nil
+}
+
+func (l *limiter) Status() LimitStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	used := l.used
+	if !startOfDay(now).Equal(l.day) {
+		used = 0
+	}
+
+	return LimitStatus{
+		Name:     l.name,
+		Mode:     l.mode,
+		Used:     used,
+		PerDay:   l.budget.PerDay,
+		ResetsAt: startOfDay(now).AddDate(0, 0, 1),
+	}
+}
+
+func startOfDay(t time.Time) time.Time {
+	t = t.In(moscow)
+
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, moscow)
+}
@@ -0,0 +1,60 @@
+package dadata
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/ilazutin/dadataproxy_go/internal/config"
+)
+
+type LimiterTestSuite struct {
+	suite.Suite
+}
+
+func (suite *LimiterTestSuite) TestRejectsWhenBucketIsEmpty() {
+	l := newLimiter("suggestions", LimitModeReject, config.RateBudget{PerSecond: 1, Burst: 2})
+
+	suite.NoError(l.take(context.Background()))
+	suite.NoError(l.take(context.Background()))
+	suite.ErrorIs(l.take(context.Background()), ErrRateLimited)
+}
+
+func (suite *LimiterTestSuite) TestQueuesUntilTokenIsAvailable() {
+	l := newLimiter("suggestions", LimitModeQueue, config.RateBudget{PerSecond: 50, Burst: 1})
+
+	started := time.Now()
+	suite.NoError(l.take(context.Background()))
+	suite.NoError(l.take(context.Background()))
+	suite.GreaterOrEqual(time.Since(started), 15*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	suite.ErrorIs(l.take(ctx), context.Canceled)
+}
+
+func (suite *LimiterTestSuite) TestDailyBudgetResetsAtMoscowMidnight() {
+	l := newLimiter("cleaner", LimitModeQueue, config.RateBudget{PerDay: 2})
+
+	// 20:59 UTC is 23:59 in Moscow, 21:00 UTC is the next Moscow day.
+	beforeMidnight := time.Date(2026, 10, 18, 20, 59, 0, 0, time.UTC)
+	afterMidnight := time.Date(2026, 10, 18, 21, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 2; i++ {
+		_, err := l.reserve(beforeMidnight)
+		suite.NoError(err)
+	}
+
+	_, err := l.reserve(beforeMidnight)
+	suite.ErrorIs(err, ErrRateLimited)
+
+	_, err = l.reserve(afterMidnight)
+	suite.NoError(err)
+}
+
+func TestLimiterTestSuite(t *testing.T) {
+	t.Parallel()
+	suite.Run(t, new(LimiterTestSuite))
+}
@@ -0,0 +1,101 @@
+package dadata
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/ilazutin/dadataproxy_go/internal/config"
+)
+
+// withRetry runs call until it succeeds, fails with a non-retryable
+// error, runs out of attempts or would exceed the policy deadline.
+// Every attempt gets the time left before the deadline, and an attempt
+// cut off by it fails as an unavailable upstream. Billed calls are made
+// once unless the policy allows retrying them.
+func withRetry(ctx context.Context, policy config.RetryPolicy, billed bool, call func(ctx context.Context) error) error {
+	attempts := max(policy.MaxAttempts, 1)
+	if billed && !policy.RetryBilled {
+		attempts = 1
+	}
+
+	started := time.Now()
+
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			wait := backoff(policy, attempt)
+			if policy.Deadline > 0 && time.Since(started)+wait >= policy.Deadline {
+				break
+			}
+
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+			}
+		}
+
+		err = attemptWithDeadline(ctx, policy.Deadline-time.Since(started), policy.Deadline > 0, call)
+		if err == nil || !retryable(err) {
+			return err
+		}
+	}
+
+	return err
+}
+
+func attemptWithDeadline(ctx context.Context, remaining time.Duration, limited bool, call func(ctx context.Context) error) error {
+	if !limited {
+		return call(ctx)
+	}
+	if remaining <= 0 {
+		return &Error{Kind: ErrUpstreamUnavailable, Err: context.DeadlineExceeded}
+	}
+
+	attemptCtx, cancel := context.WithTimeout(ctx, remaining)
+	defer cancel()
+
+	err := call(attemptCtx)
+	if err != nil && ctx.Err() == nil && errors.Is(attemptCtx.Err(), context.DeadlineExceeded) && !errors.Is(err, ErrRateLimited) {
+		return &Error{Kind: ErrUpstreamUnavailable, Err: err}
+	}
+
+	return err
+}
+
+// backoff returns a full-jitter exponential delay before the given attempt.
+func backoff(policy config.RetryPolicy, attempt int) time.Duration {
+	if policy.InitialBackoff <= 0 {
+		return 0
+	}
+
+	ceiling := policy.InitialBackoff << (attempt - 1)
+	if ceiling <= 0 || (policy.MaxBackoff > 0 && ceiling > policy.MaxBackoff) {
+		ceiling = policy.MaxBackoff
+	}
+
+	return time.Duration(rand.Int63n(int64(ceiling) + 1)) //nolint:gosec
+}
+
+func retryable(err error) bool {
+	var dadataErr *Error
+	if !errors.As(err, &dadataErr) {
+		return false
+	}
+
+	if dadataErr.Kind == ErrUpstreamUnavailable && dadataErr.Err != nil {
+		return true
+	}
+
+	switch dadataErr.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,134 @@
+package dadata
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/ilazutin/dadataproxy_go/internal/config"
+)
+
+// sequenceTransport answers with the given statuses in order and
+// repeats the last one; a zero status is a connection error.
+type sequenceTransport struct {
+	statuses []int
+	calls    atomic.Int32
+}
+
+func (t *sequenceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	call := int(t.calls.Add(1)) - 1
+	status := t.statuses[min(call, len(t.statuses)-1)]
+	if status == 0 {
+		return nil, errors.New("connection reset by peer")
+	}
+
+	body := `{"suggestions":[]}`
+	if status == http.StatusOK && strings.Contains(req.URL.Path, "clean") {
+		body = `[]`
+	}
+
+	return &http.Response{
+		StatusCode: status,
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+// hangingTransport holds every request until its context is done.
+type hangingTransport struct {
+	calls atomic.Int32
+}
+
+func (t *hangingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.calls.Add(1)
+	<-req.Context().Done()
+	return nil, req.Context().Err()
+}
+
+type RetryTestSuite struct {
+	suite.Suite
+}
+
+func (suite *RetryTestSuite) newClient(transport http.RoundTripper, retryBilled bool) *DaData {
+	policy := config.RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     5 * time.Millisecond,
+		Deadline:       time.Second,
+		RetryBilled:    retryBilled,
+	}
+
+	client, err := New(config.DaData{
+		Token:      "token",
+		CleanUrl:   "http://cleaner.local/api/v1",
+		SuggestUrl: "http://suggestions.local/api",
+		Retry:      config.DaDataRetry{Clean: policy, Suggest: policy},
+	}, transport, slog.New(slog.NewTextHandler(os.Stdout, nil)))
+	suite.Require().NoError(err)
+
+	return client
+}
+
+func (suite *RetryTestSuite) TestRetriesTransientFailures() {
+	transport := &sequenceTransport{statuses: []int{0, http.StatusBadGateway, http.StatusOK}}
+
+	_, err := suite.newClient(transport, false).GetSuggestValue(context.Background(), "/suggest/address", `{"query":"мск"}`)
+	suite.Require().NoError(err)
+	suite.Equal(int32(3), transport.calls.Load())
+}
+
+func (suite *RetryTestSuite) TestGivesUpAfterMaxAttempts() {
+	transport := &sequenceTransport{statuses: []int{http.StatusServiceUnavailable}}
+
+	_, err := suite.newClient(transport, false).GetSuggestValue(context.Background(), "/suggest/address", `{"query":"мск"}`)
+	suite.ErrorIs(err, ErrUpstreamUnavailable)
+	suite.Equal(int32(3), transport.calls.Load())
+}
+
+func (suite *RetryTestSuite) TestNeverRetriesClientErrors() {
+	for _, status := range []int{http.StatusBadRequest, http.StatusTooManyRequests} {
+		transport := &sequenceTransport{statuses: []int{status, http.StatusOK}}
+
+		_, err := suite.newClient(transport, true).GetSuggestValue(context.Background(), "/suggest/address", `{"query":"мск"}`)
+		suite.Error(err)
+		suite.Equal(int32(1), transport.calls.Load())
+	}
+}
+
+func (suite *RetryTestSuite) TestBilledCallsRetriedOnlyWhenEnabled() {
+	transport := &sequenceTransport{statuses: []int{http.StatusBadGateway, http.StatusOK}}
+	_, err := suite.newClient(transport, false).GetCleanValue(context.Background(), "/clean/address", `["мск"]`)
+	suite.ErrorIs(err, ErrUpstreamUnavailable)
+	suite.Equal(int32(1), transport.calls.Load())
+
+	transport = &sequenceTransport{statuses: []int{http.StatusBadGateway, http.StatusOK}}
+	_, err = suite.newClient(transport, true).GetCleanValue(context.Background(), "/clean/address", `["мск"]`)
+	suite.NoError(err)
+	suite.Equal(int32(2), transport.calls.Load())
+}
+
+func (suite *RetryTestSuite) TestDeadlineBoundsAttempts() {
+	transport := &hangingTransport{}
+	client := suite.newClient(transport, false)
+	client.suggest.retry.Deadline = 50 * time.Millisecond
+
+	started := time.Now()
+	_, err := client.GetSuggestValue(context.Background(), "/suggest/address", `{"query":"мск"}`)
+	suite.ErrorIs(err, ErrUpstreamUnavailable)
+	suite.Less(time.Since(started), 500*time.Millisecond)
+	suite.Equal(int32(1), transport.calls.Load())
+}
+
+func TestRetryTestSuite(t *testing.T) {
+	t.Parallel()
+	suite.Run(t, new(RetryTestSuite))
+}
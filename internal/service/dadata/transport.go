@@ -0,0 +1,72 @@
+package dadata
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/ilazutin/dadataproxy_go/internal/config"
+)
+
+func newTransport(cfg config.DaData) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	transport.Proxy = http.ProxyFromEnvironment
+	if cfg.Proxy != "" {
+		proxyUrl, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dadata proxy url: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyUrl)
+	}
+
+	tlsConfig, err := newTLSConfig(cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	transport.DialContext = (&net.Dialer{
+		Timeout:   30 * time.Second, //nolint:gomnd
+		KeepAlive: 30 * time.Second, //nolint:gomnd
+	}).DialContext
+	transport.MaxIdleConns = cfg.Pool.MaxIdleConns
+	transport.MaxIdleConnsPerHost = cfg.Pool.MaxIdleConnsPerHost
+	transport.MaxConnsPerHost = cfg.Pool.MaxConnsPerHost
+	transport.IdleConnTimeout = cfg.Pool.IdleConnTimeout
+
+	return transport, nil
+}
+
+func newTLSConfig(cfg config.DaDataTLS) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify, //nolint:gosec
+	}
+
+	if cfg.CAFile == "" {
+		return tlsConfig, nil
+	}
+
+	pem, err := os.ReadFile(cfg.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read dadata ca file: %w", err)
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in dadata ca file %s", cfg.CAFile)
+	}
+	tlsConfig.RootCAs = pool
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,360 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// jobChunkSize rows are cleaned between two progress updates.
+	jobChunkSize = 500
+
+	jobInputSuffix      = ":input"
+	jobResultSuffix     = ":result"
+	jobCheckpointSuffix = ":checkpoint"
+	jobChunkSuffix      = ":chunk:"
+)
+
+var (
+	ErrUnknownClean    = errors.New("unknown clean type")
+	ErrColumnNotFound  = errors.New("column not found in the header")
+	ErrEmptyFile       = errors.New("file has no rows")
+	ErrJobInputMissing = errors.New("job input is missing")
+)
+
+// cleanTypes maps the clean type of a job to the cleaner method.
+var cleanTypes = map[string]string{
+	"address":  "/clean/address",
+	"phone":    "/clean/phone",
+	"name":     "/clean/name",
+	"passport": "/clean/passport",
+	"email":    "/clean/email",
+}
+
+type fileJobParams struct {
+	Type   string `json:"type"`
+	Column string `json:"column"`
+}
+
+// fileJobCheckpoint is saved after every chunk, so an interrupted job
+// resumes from Offset. The cleaned rows of every chunk before it are
+// kept under their own keys.
+type fileJobCheckpoint struct {
+	Offset int   `json:"offset"`
+	Failed int64 `json:"failed"`
+}
+
+// StartFileJob saves the CSV file and cleans one of its columns in the
+// background. The result is downloaded with FileJobResult.
+func (s ProxyService) StartFileJob(ctx context.Context, file []byte, cleanType string, column string, logger *slog.Logger) (*Job, error) {
+	if _, ok := cleanTypes[cleanType]; !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownClean, cleanType)
+	}
+
+	header, _, err := readCSV(file)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := columnIndex(header, column); err != nil {
+		return nil, err
+	}
+
+	return s.startJobWith(ctx, JobKindCleanFile, fileJobParams{Type: cleanType, Column: column}, func(id string) error {
+		return s.storage.Save(ctx, s.jobKey(id)+jobInputSuffix, file, jobTTL)
+	}, logger)
+}
+
+// FileJobResult returns the input file enriched with the cleaned fields.
+func (s ProxyService) FileJobResult(ctx context.Context, id string) ([]byte, error) {
+	job, err := s.Job(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if job.Kind != JobKindCleanFile {
+		return nil, ErrJobNotFound
+	}
+	if job.Status != JobDone {
+		return nil, ErrJobNotDone
+	}
+
+	value, err := s.storage.Read(ctx, s.jobKey(id)+jobResultSuffix)
+	if err != nil || value == nil {
+		return nil, ErrJobNotFound
+	}
+
+	return []byte(value.(string)), nil
+}
+
+func (s ProxyService) cleanFileJob(id string, params fileJobParams) jobFunc {
+	return func(ctx context.Context, progress *jobProgress) (interface{}, error) {
+		result, chunks, err := s.cleanFile(ctx, id, params, progress, progress.logger)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := s.storage.Save(ctx, s.jobKey(id)+jobResultSuffix, result, jobTTL); err != nil {
+			return nil, err
+		}
+
+		if _, err := s.storage.Delete(ctx, append(chunks, s.jobKey(id)+jobCheckpointSuffix)...); err != nil {
+			progress.logger.Warn("Cannot delete job checkpoint", slog.String("error", err.Error()))
+		}
+
+		return nil, nil
+	}
+}
+
+// cleanFile cleans the column chunk by chunk and returns the file with
+// the cleaned fields and the keys of the saved chunks. Rows that cannot
+// be cleaned are logged as job errors and left empty.
+func (s ProxyService) cleanFile(ctx context.Context, id string, params fileJobParams, progress progress, logger *slog.Logger) ([]byte, []string, error) {
+	value, err := s.storage.Read(ctx, s.jobKey(id)+jobInputSuffix)
+	if err != nil || value == nil {
+		return nil, nil, ErrJobInputMissing
+	}
+
+	header, rows, err := readCSV([]byte(value.(string)))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	index, err := columnIndex(header, params.Column)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	progress.setTotal(int64(len(rows)))
+
+	path := cleanTypes[params.Type]
+	cleaned := make([]map[string]interface{}, len(rows))
+
+	var chunks []string
+	checkpoint := s.fileJobCheckpoint(ctx, id)
+	for start := 0; start < checkpoint.Offset; start += jobChunkSize {
+		chunkKey := s.jobKey(id) + jobChunkSuffix + strconv.Itoa(start)
+		if err := s.readFileJobChunk(ctx, chunkKey, cleaned[start:min(start+jobChunkSize, len(rows))]); err != nil {
+			logger.Warn("Cannot restore job chunk, start over", slog.String("error", err.Error()))
+			checkpoint, chunks = fileJobCheckpoint{}, nil
+			break
+		}
+		chunks = append(chunks, chunkKey)
+	}
+	if checkpoint.Offset > 0 {
+		logger.Info("Resume file job", slog.Int("offset", checkpoint.Offset))
+		progress.resume(ctx, int64(checkpoint.Offset), checkpoint.Failed)
+	}
+
+	for start := checkpoint.Offset; start < len(rows); start += jobChunkSize {
+		end := min(start+jobChunkSize, len(rows))
+
+		var (
+			items     []string
+			positions []int
+		)
+		for position := start; position < end; position++ {
+			if index < len(rows[position]) && strings.TrimSpace(rows[position][index]) != "" {
+				items = append(items, rows[position][index])
+				positions = append(positions, position)
+			}
+		}
+
+		if len(items) > 0 {
+			data, err := json.Marshal(items)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			result, _, err := s.CleanBatch(ctx, path, string(data), false, logger)
+			if ctx.Err() != nil {
+				return nil, nil, ctx.Err()
+			}
+
+			failed := make(map[int]bool)
+			var batchErr *BatchError
+			switch {
+			case errors.As(err, &batchErr):
+				for _, item := range batchErr.Positions {
+					failed[item] = true
+				}
+			case err != nil:
+				for item := range positions {
+					failed[item] = true
+				}
+			}
+
+			for item, position := range positions {
+				if failed[item] {
+					checkpoint.Failed++
+					progress.fail(ctx, "row "+strconv.Itoa(position+1), err)
+					continue
+				}
+				cleaned[position] = (*result)[item]
+			}
+		}
+
+		chunkKey := s.jobKey(id) + jobChunkSuffix + strconv.Itoa(start)
+		if err := s.saveFileJobChunk(ctx, chunkKey, cleaned[start:end]); err != nil {
+			return nil, nil, err
+		}
+		chunks = append(chunks, chunkKey)
+
+		checkpoint.Offset = end
+		if err := s.saveFileJobCheckpoint(ctx, id, checkpoint); err != nil {
+			return nil, nil, err
+		}
+
+		progress.advance(ctx, int64(end-start))
+	}
+
+	result, err := writeCSV(header, rows, cleaned, params.Type)
+
+	return result, chunks, err
+}
+
+func (s ProxyService) fileJobCheckpoint(ctx context.Context, id string) fileJobCheckpoint {
+	var checkpoint fileJobCheckpoint
+
+	value, err := s.storage.Read(ctx, s.jobKey(id)+jobCheckpointSuffix)
+	if err != nil || value == nil {
+		return checkpoint
+	}
+
+	if json.Unmarshal([]byte(value.(string)), &checkpoint) != nil {
+		return fileJobCheckpoint{}
+	}
+
+	return checkpoint
+}
+
+func (s ProxyService) saveFileJobCheckpoint(ctx context.Context, id string, checkpoint fileJobCheckpoint) error {
+	value, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	return s.storage.Save(ctx, s.jobKey(id)+jobCheckpointSuffix, value, jobTTL)
+}
+
+func (s ProxyService) readFileJobChunk(ctx context.Context, key string, cleaned []map[string]interface{}) error {
+	value, err := s.storage.Read(ctx, key)
+	if err != nil || value == nil {
+		return ErrJobInputMissing
+	}
+
+	var chunk []map[string]interface{}
+	if err := json.Unmarshal([]byte(value.(string)), &chunk); err != nil {
+		return err
+	}
+	if len(chunk) != len(cleaned) {
+		return fmt.Errorf("%w: chunk has %d rows, expected %d", ErrJobInputMissing, len(chunk), len(cleaned))
+	}
+
+	copy(cleaned, chunk)
+
+	return nil
+}
+
+func (s ProxyService) saveFileJobChunk(ctx context.Context, key string, cleaned []map[string]interface{}) error {
+	value, err := json.Marshal(cleaned)
+	if err != nil {
+		return err
+	}
+
+	return s.storage.Save(ctx, key, value, jobTTL)
+}
+
+func readCSV(file []byte) ([]string, [][]string, error) {
+	reader := csv.NewReader(bytes.NewReader(file))
+	reader.FieldsPerRecord = -1
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(records) < 2 {
+		return nil, nil, ErrEmptyFile
+	}
+
+	return records[0], records[1:], nil
+}
+
+func columnIndex(header []string, column string) (int, error) {
+	for index, name := range header {
+		if strings.TrimSpace(name) == column {
+			return index, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w: %s", ErrColumnNotFound, column)
+}
+
+// writeCSV appends the cleaned fields, prefixed with the clean type, to
+// every row.
+func writeCSV(header []string, rows [][]string, cleaned []map[string]interface{}, cleanType string) ([]byte, error) {
+	fieldSet := make(map[string]bool)
+	for _, result := range cleaned {
+		for field := range result {
+			fieldSet[field] = true
+		}
+	}
+	delete(fieldSet, "source")
+
+	fields := make([]string, 0, len(fieldSet))
+	for field := range fieldSet {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	buffer := new(bytes.Buffer)
+	writer := csv.NewWriter(buffer)
+
+	record := append([]string{}, header...)
+	for _, field := range fields {
+		record = append(record, cleanType+"_"+field)
+	}
+	if err := writer.Write(record); err != nil {
+		return nil, err
+	}
+
+	for position, row := range rows {
+		record = append(record[:0], row...)
+		for len(record) < len(header) {
+			record = append(record, "")
+		}
+
+		for _, field := range fields {
+			record = append(record, formatField(cleaned[position][field]))
+		}
+		if err := writer.Write(record); err != nil {
+			return nil, err
+		}
+	}
+
+	writer.Flush()
+
+	return buffer.Bytes(), writer.Error()
+}
+
+func formatField(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(value)
+	default:
+		encoded, _ := json.Marshal(value)
+		return string(encoded)
+	}
+}
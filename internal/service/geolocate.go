@@ -0,0 +1,83 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+
+	"github.com/ilazutin/dadataproxy_go/internal/service/dadata"
+)
+
+const maxGeolocateRadius = 1000
+
+var (
+	ErrInvalidCoordinates = errors.New("invalid coordinates")
+)
+
+func (s ProxyService) GeolocateValue(ctx context.Context, path string, data string, ignoreCache bool, logger *slog.Logger) (*dadata.DaDataSuggest, bool, error) {
+	if err := validateCoordinates(data); err != nil {
+		return nil, false, err
+	}
+
+	return newPipeline(s, s.dadata.GetSuggestValue).run(ctx, path, data, ignoreCache, logger)
+}
+
+func validateCoordinates(data string) error {
+	var query map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &query); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidCoordinates, err)
+	}
+
+	if _, err := coordinate(query, "lat", 90); err != nil {
+		return err
+	}
+	if _, err := coordinate(query, "lon", 180); err != nil {
+		return err
+	}
+
+	if _, ok := query["radius_meters"]; ok {
+		radius, err := coordinate(query, "radius_meters", maxGeolocateRadius)
+		if err != nil {
+			return err
+		}
+		if radius <= 0 {
+			return fmt.Errorf("%w: radius_meters must be positive", ErrInvalidCoordinates)
+		}
+	}
+
+	return nil
+}
+
+// coordinate reads a number (or a numeric string) and checks that it
+// lies within [-limit, limit].
+func coordinate(query map[string]interface{}, name string, limit float64) (float64, error) {
+	var value float64
+	switch v := query[name].(type) {
+	case float64:
+		value = v
+	case string:
+		parsed, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %s is not a number", ErrInvalidCoordinates, name)
+		}
+		value = parsed
+	case nil:
+		return 0, fmt.Errorf("%w: %s is required", ErrInvalidCoordinates, name)
+	default:
+		return 0, fmt.Errorf("%w: %s is not a number", ErrInvalidCoordinates, name)
+	}
+
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, fmt.Errorf("%w: %s is not a finite number", ErrInvalidCoordinates, name)
+	}
+
+	if value < -limit || value > limit {
+		return 0, fmt.Errorf("%w: %s must be within [-%g, %g]", ErrInvalidCoordinates, name, limit, limit)
+	}
+
+	return value, nil
+}
@@ -0,0 +1,716 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	JobPending   = "pending"
+	JobRunning   = "running"
+	JobDone      = "done"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+
+	JobKindCleanFile  = "clean_file"
+	JobKindMigrate    = "migrate"
+	JobKindMigrations = "migrations"
+	JobKindWarm       = "warm"
+	JobKindInvalidate = "invalidate"
+
+	jobTTL = 7 * 24 * time.Hour
+	// jobFlushInterval limits how often the progress is saved.
+	jobFlushInterval = time.Second
+	// maxJobErrors is the length of the error log kept for a job.
+	maxJobErrors = 1000
+	// jobLease is how long a job stays owned by the instance running it
+	// without a heartbeat. Other instances take over the jobs whose lease
+	// expired.
+	jobLease = 30 * time.Second
+	// jobUpdateAttempts limits the retries of a job update that races
+	// with another one.
+	jobUpdateAttempts = 10
+
+	jobErrorsSuffix = ":errors"
+	// jobEndpoint prefixes the kind of a job in the usage counters of the
+	// upstream calls it makes.
+	jobEndpoint = "job:"
+)
+
+var (
+	ErrJobNotFound    = errors.New("job not found")
+	ErrJobNotDone     = errors.New("job is not done")
+	ErrJobFinished    = errors.New("job is already finished")
+	ErrUnknownJobKind = errors.New("unknown job kind")
+	ErrJobConflict    = errors.New("job is updated concurrently")
+
+	errJobCancelled = errors.New("job cancelled")
+	errJobOwned     = errors.New("job is run by another instance")
+	errJobLost      = errors.New("job was taken over by another instance")
+	errStopScan     = errors.New("stop scan")
+)
+
+// Job is a long operation run in the background. Its state is kept in
+// the storage, so it can be polled from any instance. The instance
+// running a job owns it while it extends the lease; a restarted proxy or
+// another instance resumes the job once the lease expired.
+type Job struct {
+	ID         string          `json:"id"`
+	Kind       string          `json:"kind"`
+	Status     string          `json:"status"`
+	Params     json.RawMessage `json:"params,omitempty"`
+	Total      int64           `json:"total"`
+	Processed  int64           `json:"processed"`
+	Failed     int64           `json:"failed"`
+	Result     json.RawMessage `json:"result,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	Owner      string          `json:"owner,omitempty"`
+	LeaseUntil time.Time       `json:"lease_until"`
+	CreatedAt  time.Time       `json:"created_at"`
+	UpdatedAt  time.Time       `json:"updated_at"`
+}
+
+// JobError is an entry of the error log of a job.
+type JobError struct {
+	Key   string    `json:"key"`
+	Error string    `json:"error"`
+	Time  time.Time `json:"time"`
+}
+
+// jobFunc does the work of a job and returns its result.
+type jobFunc func(ctx context.Context, progress *jobProgress) (interface{}, error)
+
+// jobRunner tracks the jobs running in this process. owner identifies
+// the process in the jobs it runs.
+type jobRunner struct {
+	mu      sync.Mutex
+	owner   string
+	base    context.Context
+	cancels map[string]context.CancelCauseFunc
+}
+
+func newJobRunner() *jobRunner {
+	owner, _ := newJobID()
+
+	return &jobRunner{owner: owner, cancels: make(map[string]context.CancelCauseFunc)}
+}
+
+// start registers the job id as running on this instance, reporting false
+// when it already is.
+func (r *jobRunner) start(id string, cancel context.CancelCauseFunc) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.cancels[id]; ok {
+		return false
+	}
+	r.cancels[id] = cancel
+	return true
+}
+
+func (r *jobRunner) stop(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.cancels, id)
+}
+
+func (r *jobRunner) running(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, ok := r.cancels[id]
+	return ok
+}
+
+func (s ProxyService) Job(ctx context.Context, id string) (*Job, error) {
+	value, err := s.storage.Read(ctx, s.jobKey(id))
+	if err != nil || value == nil {
+		return nil, ErrJobNotFound
+	}
+
+	var job Job
+	if err := json.Unmarshal([]byte(value.(string)), &job); err != nil {
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+func (s ProxyService) JobErrors(ctx context.Context, id string) ([]JobError, error) {
+	if _, err := s.Job(ctx, id); err != nil {
+		return nil, err
+	}
+
+	result := []JobError{}
+
+	value, err := s.storage.Read(ctx, s.jobKey(id)+jobErrorsSuffix)
+	if err != nil || value == nil {
+		return result, nil
+	}
+
+	err = json.Unmarshal([]byte(value.(string)), &result)
+
+	return result, err
+}
+
+// CancelJob stops a pending or running job. The job notices it on the
+// next progress update, even when it runs on another instance.
+func (s ProxyService) CancelJob(ctx context.Context, id string, logger *slog.Logger) (*Job, error) {
+	job, err := s.updateJob(ctx, id, func(job *Job) error {
+		if job.Status != JobPending && job.Status != JobRunning {
+			return ErrJobFinished
+		}
+
+		job.Status = JobCancelled
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.jobs.mu.Lock()
+	if cancel, ok := s.jobs.cancels[id]; ok {
+		cancel(errJobCancelled)
+	}
+	s.jobs.mu.Unlock()
+
+	logger.Info("Job cancelled", slog.String("job", id), slog.String("kind", job.Kind))
+
+	return job, nil
+}
+
+// ResumeJobs restarts the interrupted jobs whose lease expired, and runs
+// the jobs started later within ctx. It keeps looking for the jobs left
+// by stopped instances until ctx is done. File jobs continue from their
+// last checkpoint; the other jobs start over, as the work done before is
+// cheap to repeat: warmed queries are refreshed and migrated keys no
+// longer match.
+func (s ProxyService) ResumeJobs(ctx context.Context, logger *slog.Logger) error {
+	s.jobs.mu.Lock()
+	s.jobs.base = ctx
+	s.jobs.mu.Unlock()
+
+	if err := s.resumeJobs(ctx, logger); err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(jobLease)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			if err := s.resumeJobs(ctx, logger); err != nil && ctx.Err() == nil {
+				logger.Error("Cannot resume jobs", slog.String("error", err.Error()))
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (s ProxyService) resumeJobs(ctx context.Context, logger *slog.Logger) error {
+	return s.scanJobs(ctx, logger, func(job *Job) bool {
+		if (job.Status == JobPending || job.Status == JobRunning) && job.LeaseUntil.Before(time.Now()) && !s.jobs.running(job.ID) {
+			logger.Info("Resume job", slog.String("job", job.ID), slog.String("kind", job.Kind), slog.String("owner", job.Owner))
+			go s.runJob(ctx, job, logger)
+		}
+
+		return true
+	})
+}
+
+// activeJob returns a pending or running job of kind accepted by match,
+// or nil when there is none.
+func (s ProxyService) activeJob(ctx context.Context, kind string, match func(job *Job) bool) (*Job, error) {
+	var active *Job
+	err := s.scanJobs(ctx, s.logger, func(job *Job) bool {
+		if job.Kind == kind && (job.Status == JobPending || job.Status == JobRunning) && match(job) {
+			active = job
+			return false
+		}
+
+		return true
+	})
+
+	return active, err
+}
+
+// scanJobs calls fn with every stored job until fn returns false.
+func (s ProxyService) scanJobs(ctx context.Context, logger *slog.Logger, fn func(job *Job) bool) error {
+	err := s.storage.ScanKeys(ctx, s.jobKey("*"), s.config.ScanCount, func(keys []string) error {
+		for _, key := range keys {
+			id := strings.TrimPrefix(key, s.jobKey(""))
+			if strings.Contains(id, ":") {
+				continue
+			}
+
+			job, err := s.Job(ctx, id)
+			if err != nil {
+				logger.Error("Cannot read job", slog.String("key", key), slog.String("error", err.Error()))
+				continue
+			}
+
+			if !fn(job) {
+				return errStopScan
+			}
+		}
+
+		return nil
+	})
+	if errors.Is(err, errStopScan) {
+		return nil
+	}
+
+	return err
+}
+
+func (s ProxyService) startJob(ctx context.Context, kind string, params interface{}, logger *slog.Logger) (*Job, error) {
+	return s.startJobWith(ctx, kind, params, nil, logger)
+}
+
+// startJobWith saves the job, calls prepare with its id to store any
+// input, and runs the job in the background.
+func (s ProxyService) startJobWith(ctx context.Context, kind string, params interface{}, prepare func(id string) error, logger *slog.Logger) (*Job, error) {
+	encodedParams, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+
+	if prepare != nil {
+		if err := prepare(id); err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	job := &Job{
+		ID:         id,
+		Kind:       kind,
+		Status:     JobPending,
+		Params:     encodedParams,
+		Owner:      s.jobs.owner,
+		LeaseUntil: now.Add(jobLease),
+		CreatedAt:  now,
+	}
+	if err := s.createJob(ctx, job); err != nil {
+		return nil, err
+	}
+
+	logger.Info("Job created", slog.String("job", id), slog.String("kind", kind))
+
+	s.jobs.mu.Lock()
+	base := s.jobs.base
+	s.jobs.mu.Unlock()
+	if base == nil {
+		base = context.WithoutCancel(ctx)
+	}
+
+	created := *job
+	go s.runJob(base, job, logger)
+
+	return &created, nil
+}
+
+func (s ProxyService) runJob(ctx context.Context, job *Job, logger *slog.Logger) {
+	logger = logger.With(slog.String("job", job.ID), slog.String("kind", job.Kind))
+	ctx = WithEndpoint(ctx, jobEndpoint+job.Kind)
+
+	// The job is registered before it is claimed, so a claim by this
+	// instance never takes over a run of the same job still going on here.
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	if !s.jobs.start(job.ID, cancel) {
+		logger.Debug("Job is already running on this instance")
+		return
+	}
+	defer s.jobs.stop(job.ID)
+
+	job, err := s.claimJob(ctx, job.ID)
+	if errors.Is(err, errJobOwned) || errors.Is(err, ErrJobFinished) {
+		logger.Debug("Job is not claimed", slog.String("reason", err.Error()))
+		return
+	}
+	if err != nil {
+		logger.Error("Cannot claim job", slog.String("error", err.Error()))
+		return
+	}
+
+	run, err := s.jobFunc(job)
+	if err != nil {
+		s.finishJob(ctx, job, nil, err, logger)
+		return
+	}
+
+	progress := &jobProgress{service: s, job: job, flushed: time.Now(), cancel: cancel, logger: logger}
+	go progress.heartbeat(ctx)
+
+	result, err := run(ctx, progress)
+
+	switch cause := context.Cause(ctx); {
+	case errors.Is(cause, errJobCancelled):
+		if err := progress.save(context.WithoutCancel(ctx), JobCancelled); err != nil {
+			logger.Warn("Cannot save job progress", slog.String("error", err.Error()))
+		}
+		logger.Info("Job stopped", slog.Int64("processed", job.Processed))
+		return
+	case errors.Is(cause, errJobLost):
+		logger.Warn("Job taken over", slog.Int64("processed", job.Processed))
+		return
+	case ctx.Err() != nil:
+		logger.Warn("Job interrupted", slog.Int64("processed", job.Processed))
+		return
+	}
+
+	progress.saveErrors(ctx)
+	s.finishJob(ctx, job, result, err, logger)
+}
+
+// claimJob makes this instance the owner of a pending or running job
+// unless another instance holds its lease.
+func (s ProxyService) claimJob(ctx context.Context, id string) (*Job, error) {
+	return s.updateJob(ctx, id, func(job *Job) error {
+		if job.Status != JobPending && job.Status != JobRunning {
+			return ErrJobFinished
+		}
+		if job.Owner != s.jobs.owner && job.LeaseUntil.After(time.Now()) {
+			return errJobOwned
+		}
+
+		job.Owner = s.jobs.owner
+		job.LeaseUntil = time.Now().Add(jobLease)
+		job.Status = JobRunning
+		job.Total, job.Processed, job.Failed = 0, 0, 0
+		return nil
+	})
+}
+
+// finishJob saves the outcome of a job still running on this instance;
+// a job cancelled or taken over meanwhile keeps its status.
+func (s ProxyService) finishJob(ctx context.Context, job *Job, result interface{}, err error, logger *slog.Logger) {
+	job.Status = JobDone
+	if err != nil {
+		logger.Error("Job failed", slog.String("error", err.Error()))
+		job.Status = JobFailed
+		job.Error = err.Error()
+	}
+
+	if result != nil {
+		job.Result, _ = json.Marshal(result)
+	}
+
+	_, err = s.updateJob(ctx, job.ID, func(stored *Job) error {
+		if err := ownedJob(stored, job.Owner, JobRunning); err != nil {
+			return err
+		}
+
+		stored.Status, stored.Result, stored.Error = job.Status, job.Result, job.Error
+		stored.Total, stored.Processed, stored.Failed = job.Total, job.Processed, job.Failed
+		return nil
+	})
+	if errors.Is(err, errJobCancelled) || errors.Is(err, errJobLost) {
+		logger.Info("Job finished after its status changed", slog.String("reason", err.Error()))
+		return
+	}
+	if err != nil {
+		logger.Error("Cannot save job", slog.String("error", err.Error()))
+		return
+	}
+
+	logger.Info("Job finished",
+		slog.String("status", job.Status),
+		slog.Int64("processed", job.Processed),
+		slog.Int64("failed", job.Failed),
+	)
+}
+
+// ownedJob reports why the instance owning a job with status may no
+// longer update the stored job.
+func ownedJob(stored *Job, owner string, status string) error {
+	if stored.Status == JobCancelled && status != JobCancelled {
+		return errJobCancelled
+	}
+	if stored.Owner != owner || stored.Status != status {
+		return errJobLost
+	}
+
+	return nil
+}
+
+// jobFunc restores the work of a job from its kind and parameters.
+func (s ProxyService) jobFunc(job *Job) (jobFunc, error) {
+	switch job.Kind {
+	case JobKindCleanFile:
+		var params fileJobParams
+		if err := json.Unmarshal(job.Params, &params); err != nil {
+			return nil, err
+		}
+		return s.cleanFileJob(job.ID, params), nil
+	case JobKindMigrate:
+		var params migrateJobParams
+		if err := json.Unmarshal(job.Params, &params); err != nil {
+			return nil, err
+		}
+		return s.migrateJob(params), nil
+	case JobKindMigrations:
+		var params migrationsJobParams
+		if err := json.Unmarshal(job.Params, &params); err != nil {
+			return nil, err
+		}
+		return s.migrationsJob(params), nil
+	case JobKindWarm:
+		var params warmJobParams
+		if err := json.Unmarshal(job.Params, &params); err != nil {
+			return nil, err
+		}
+		return s.warmJob(params), nil
+	case JobKindInvalidate:
+		var params invalidateJobParams
+		if err := json.Unmarshal(job.Params, &params); err != nil {
+			return nil, err
+		}
+		return s.invalidateJob(params), nil
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrUnknownJobKind, job.Kind)
+}
+
+func (s ProxyService) createJob(ctx context.Context, job *Job) error {
+	job.UpdatedAt = time.Now()
+
+	value, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	saved, err := s.storage.SaveIfAbsent(ctx, s.jobKey(job.ID), value, jobTTL)
+	if err != nil {
+		return err
+	}
+	if !saved {
+		return ErrJobConflict
+	}
+
+	return nil
+}
+
+// updateJob applies update to the stored job and saves it only when the
+// job was not changed meanwhile, so the job, its heartbeat and a
+// cancellation never overwrite each other. The update is retried on a
+// conflict; an error of update is returned as is.
+func (s ProxyService) updateJob(ctx context.Context, id string, update func(job *Job) error) (*Job, error) {
+	for attempt := 0; attempt < jobUpdateAttempts; attempt++ {
+		value, err := s.storage.Read(ctx, s.jobKey(id))
+		if err != nil || value == nil {
+			return nil, ErrJobNotFound
+		}
+
+		var job Job
+		if err := json.Unmarshal([]byte(value.(string)), &job); err != nil {
+			return nil, err
+		}
+
+		if err := update(&job); err != nil {
+			return nil, err
+		}
+		job.UpdatedAt = time.Now()
+
+		updated, err := json.Marshal(job)
+		if err != nil {
+			return nil, err
+		}
+
+		swapped, err := s.storage.CompareAndSwap(ctx, s.jobKey(id), value.(string), updated, jobTTL)
+		if err != nil {
+			return nil, err
+		}
+		if swapped {
+			return &job, nil
+		}
+	}
+
+	return nil, ErrJobConflict
+}
+
+// jobKey lives outside the versioned cache namespace, so cache
+// invalidation and migration leave jobs alone.
+func (s ProxyService) jobKey(id string) string {
+	return s.config.KeyPrefix + jobsSegment + id
+}
+
+func newJobID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(id), nil
+}
+
+// progress receives the progress of a long operation.
+type progress interface {
+	setTotal(total int64)
+	advance(ctx context.Context, n int64)
+	fail(ctx context.Context, key string, err error)
+	// resume restores the counters of an operation continued from a
+	// checkpoint.
+	resume(ctx context.Context, processed int64, failed int64)
+}
+
+// discardProgress is the progress of an operation run outside a job.
+type discardProgress struct{}
+
+func (discardProgress) setTotal(int64)                       {}
+func (discardProgress) advance(context.Context, int64)       {}
+func (discardProgress) fail(context.Context, string, error)  {}
+func (discardProgress) resume(context.Context, int64, int64) {}
+
+// jobProgress saves the progress of a running job at most once per
+// jobFlushInterval. It is used by the job goroutine only, except for the
+// heartbeat which touches the stored job alone.
+type jobProgress struct {
+	service ProxyService
+	job     *Job
+	errors  []JobError
+	flushed time.Time
+	cancel  context.CancelCauseFunc
+	logger  *slog.Logger
+}
+
+func (p *jobProgress) setTotal(total int64) {
+	p.job.Total = total
+}
+
+func (p *jobProgress) advance(ctx context.Context, n int64) {
+	p.job.Processed += n
+	p.maybeFlush(ctx)
+}
+
+func (p *jobProgress) fail(ctx context.Context, key string, err error) {
+	p.job.Failed++
+	if len(p.errors) < maxJobErrors {
+		p.errors = append(p.errors, JobError{Key: key, Error: err.Error(), Time: time.Now()})
+	}
+	p.maybeFlush(ctx)
+}
+
+// resume restores the counters and keeps the error log saved before the
+// job was interrupted.
+func (p *jobProgress) resume(ctx context.Context, processed int64, failed int64) {
+	p.job.Processed, p.job.Failed = processed, failed
+
+	jobErrors, err := p.service.JobErrors(ctx, p.job.ID)
+	if err == nil {
+		p.errors = jobErrors
+	}
+}
+
+func (p *jobProgress) maybeFlush(ctx context.Context) {
+	if time.Since(p.flushed) < jobFlushInterval {
+		return
+	}
+
+	if err := p.flush(ctx); err != nil {
+		p.logger.Warn("Cannot save job progress", slog.String("error", err.Error()))
+	}
+}
+
+// flush saves the progress, and stops the job when it was cancelled or
+// taken over meanwhile.
+func (p *jobProgress) flush(ctx context.Context) error {
+	p.flushed = time.Now()
+
+	if err := p.save(ctx, JobRunning); err != nil {
+		return err
+	}
+
+	p.saveErrors(ctx)
+
+	return nil
+}
+
+// save stores the counters and extends the lease while the job is owned
+// by this instance and has status.
+func (p *jobProgress) save(ctx context.Context, status string) error {
+	_, err := p.service.updateJob(ctx, p.job.ID, func(stored *Job) error {
+		if err := ownedJob(stored, p.job.Owner, status); err != nil {
+			return err
+		}
+
+		stored.Total, stored.Processed, stored.Failed = p.job.Total, p.job.Processed, p.job.Failed
+		stored.LeaseUntil = time.Now().Add(jobLease)
+		return nil
+	})
+	if errors.Is(err, errJobCancelled) || errors.Is(err, errJobLost) {
+		p.cancel(err)
+		return nil
+	}
+
+	return err
+}
+
+// heartbeat extends the lease until ctx is done, so a job busy with a
+// long chunk is not taken over.
+func (p *jobProgress) heartbeat(ctx context.Context) {
+	ticker := time.NewTicker(jobLease / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		_, err := p.service.updateJob(ctx, p.job.ID, func(stored *Job) error {
+			if err := ownedJob(stored, p.job.Owner, JobRunning); err != nil {
+				return err
+			}
+
+			stored.LeaseUntil = time.Now().Add(jobLease)
+			return nil
+		})
+		switch {
+		case errors.Is(err, errJobCancelled) || errors.Is(err, errJobLost):
+			p.cancel(err)
+			return
+		case err != nil && ctx.Err() == nil:
+			p.logger.Warn("Cannot extend job lease", slog.String("error", err.Error()))
+		}
+	}
+}
+
+func (p *jobProgress) saveErrors(ctx context.Context) {
+	if len(p.errors) == 0 {
+		return
+	}
+
+	value, err := json.Marshal(p.errors)
+	if err != nil {
+		return
+	}
+
+	if err := p.service.storage.Save(ctx, p.service.jobKey(p.job.ID)+jobErrorsSuffix, value, jobTTL); err != nil {
+		p.logger.Warn("Cannot save job errors", slog.String("error", err.Error()))
+	}
+}
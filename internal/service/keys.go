@@ -0,0 +1,85 @@
+package service
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// legacyKeyVersion covers the keys written before namespacing: bare
+	// sha256 hashes of path and query, and "<segment>:<hash>" keys. Any
+	// other version is the "<prefix>:v<version>:" namespace.
+	legacyKeyVersion = 0
+	// normalizedKeyVersion is the first version whose keys hash the
+	// normalised query.
+	normalizedKeyVersion = 3
+
+	// sourcePath is the path whose cached values carry their query in
+	// the "source" field, so their keys can be derived again from them.
+	sourcePath = "/clean/address"
+
+	staleSuffix = ":stale"
+)
+
+// keySegments are the top-level path segments the proxy has cached
+// under "<segment>:<hash>" keys.
+var keySegments = []string{"clean", "suggest", "iplocate", "findById", "geolocate"}
+
+// legacyHashMatch matches the bare sha256 hashes only, so migrating them
+// does not read the rest of the keyspace.
+var legacyHashMatch = strings.Repeat("[0-9a-f]", sha256.Size*2)
+
+func (s ProxyService) makeKey(path string, query string) string {
+	return s.keyNamespace(s.config.KeyVersion) + s.pathSegment(path) + ":" + s.makeHash(path, query)
+}
+
+func (s ProxyService) staleKey(storageKey string) string {
+	return storageKey + staleSuffix
+}
+
+func (s ProxyService) keyTTL(key string, path string) time.Duration {
+	policy := s.policy(path)
+	if strings.HasSuffix(key, staleSuffix) {
+		return policy.StaleTTL
+	}
+
+	return policy.TTL
+}
+
+func (s ProxyService) keyNamespace(version int) string {
+	return fmt.Sprintf("%s:v%d:", s.config.KeyPrefix, version)
+}
+
+func (s ProxyService) pathSegment(path string) string {
+	return strings.ReplaceAll(strings.Trim(path, "/"), "/", ":")
+}
+
+// segmentPath restores the request path from an unprefixed
+// "<segment>:<hash>" key.
+func (s ProxyService) segmentPath(key string) (string, bool) {
+	key = strings.TrimSuffix(key, staleSuffix)
+
+	index := strings.LastIndex(key, ":")
+	if index <= 0 {
+		return "", false
+	}
+
+	return "/" + strings.ReplaceAll(key[:index], ":", "/"), true
+}
+
+// isHash reports whether s has the form of a makeHash result.
+func isHash(s string) bool {
+	if len(s) != sha256.Size*2 {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		if !('0' <= s[i] && s[i] <= '9' || 'a' <= s[i] && s[i] <= 'f') {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,525 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ilazutin/dadataproxy_go/internal/service/dadata"
+	"github.com/ilazutin/dadataproxy_go/internal/storage"
+)
+
+const (
+	// migrationMarkerTTL keeps markers for good: the storages treat a
+	// zero TTL as their default expiration.
+	migrationMarkerTTL = 100 * 365 * 24 * time.Hour
+	// migrationLeaseTTL frees the lease of an instance stopped while
+	// applying a migration. The lease is extended after every batch.
+	migrationLeaseTTL = 5 * time.Minute
+
+	migrationLeaseSuffix = ":lease"
+)
+
+var (
+	ErrInvalidVersion     = errors.New("cannot migrate from the current or a newer key version")
+	ErrDuplicateMigration = errors.New("migration is already registered")
+	ErrInvalidMigration   = errors.New("migration needs an id, a match pattern and a transform")
+	ErrValueNotString     = errors.New("cached value is not a string")
+	ErrMigrationLocked    = errors.New("migration is being applied by another instance")
+	ErrMigrationLeaseLost = errors.New("migration lease expired")
+)
+
+// Migration rewrites the cache entries whose keys match Match. Transform
+// returns the new key and the request path it belongs to, or an empty
+// key when the entry has to be skipped. Registered migrations run in
+// order, each once per environment.
+type Migration struct {
+	ID        string
+	Match     string
+	Transform func(key string, value string) (string, string, error)
+}
+
+type MigrationStatus struct {
+	ID        string     `json:"id"`
+	Match     string     `json:"match"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+}
+
+type MigrationResult struct {
+	ID       string `json:"id"`
+	Skipped  bool   `json:"skipped,omitempty"`
+	DryRun   bool   `json:"dry_run,omitempty"`
+	Matched  int64  `json:"matched"`
+	Migrated int64  `json:"migrated"`
+	Failed   int64  `json:"failed"`
+}
+
+// migrationMarker records that a migration was applied without failed
+// keys.
+type migrationMarker struct {
+	AppliedAt time.Time `json:"applied_at"`
+	Migrated  int64     `json:"migrated"`
+}
+
+type migrationRegistry struct {
+	mu         sync.Mutex
+	migrations []Migration
+}
+
+// RegisterMigration adds a migration after the registered ones.
+func (s ProxyService) RegisterMigration(migration Migration) error {
+	if migration.ID == "" || migration.Match == "" || migration.Transform == nil {
+		return ErrInvalidMigration
+	}
+
+	s.registry.mu.Lock()
+	defer s.registry.mu.Unlock()
+
+	for _, registered := range s.registry.migrations {
+		if registered.ID == migration.ID {
+			return fmt.Errorf("%w: %s", ErrDuplicateMigration, migration.ID)
+		}
+	}
+
+	s.registry.migrations = append(s.registry.migrations, migration)
+
+	return nil
+}
+
+func (s ProxyService) registeredMigrations() []Migration {
+	s.registry.mu.Lock()
+	defer s.registry.mu.Unlock()
+
+	return append([]Migration{}, s.registry.migrations...)
+}
+
+// registerKeyMigrations registers the migrations of the key scheme: the
+// legacy and segment keys, then every older namespace.
+func (s ProxyService) registerKeyMigrations() {
+	for version := legacyKeyVersion; version < s.config.KeyVersion; version++ {
+		for _, migration := range s.keyMigrations(version) {
+			s.RegisterMigration(migration) //nolint:errcheck
+		}
+	}
+}
+
+// Migrations lists the registered migrations and when they were applied.
+func (s ProxyService) Migrations(ctx context.Context) ([]MigrationStatus, error) {
+	migrations := s.registeredMigrations()
+
+	result := make([]MigrationStatus, 0, len(migrations))
+	for _, migration := range migrations {
+		marker, err := s.migrationMarker(ctx, migration.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		status := MigrationStatus{ID: migration.ID, Match: migration.Match}
+		if marker != nil {
+			status.AppliedAt = &marker.AppliedAt
+		}
+		result = append(result, status)
+	}
+
+	return result, nil
+}
+
+// RunMigrations applies the registered migrations not applied yet. A dry
+// run only counts the entries that would be migrated.
+func (s ProxyService) RunMigrations(ctx context.Context, dryRun bool, logger *slog.Logger) ([]MigrationResult, error) {
+	return s.runMigrations(ctx, dryRun, discardProgress{}, logger)
+}
+
+func (s ProxyService) runMigrations(ctx context.Context, dryRun bool, progress progress, logger *slog.Logger) ([]MigrationResult, error) {
+	var results []MigrationResult
+	for _, migration := range s.registeredMigrations() {
+		marker, err := s.migrationMarker(ctx, migration.ID)
+		if err != nil {
+			return results, err
+		}
+		if marker != nil {
+			results = append(results, MigrationResult{ID: migration.ID, Skipped: true})
+			continue
+		}
+
+		if dryRun {
+			result, err := s.applyMigration(ctx, migration, true, nil, progress, logger)
+			results = append(results, result)
+			if err != nil {
+				return results, err
+			}
+			continue
+		}
+
+		result, err := s.runMigration(ctx, migration, progress, logger)
+		results = append(results, result)
+		if err != nil {
+			return results, err
+		}
+	}
+
+	return results, nil
+}
+
+// runMigration applies a migration under its lease, so the instances
+// started together apply it once, and marks it applied when no key
+// failed; otherwise the next run retries it.
+func (s ProxyService) runMigration(ctx context.Context, migration Migration, progress progress, logger *slog.Logger) (MigrationResult, error) {
+	lease, err := s.acquireMigrationLease(ctx, migration.ID)
+	if err != nil {
+		return MigrationResult{ID: migration.ID}, err
+	}
+	defer lease.release(context.WithoutCancel(ctx), logger)
+
+	marker, err := s.migrationMarker(ctx, migration.ID)
+	if err != nil {
+		return MigrationResult{ID: migration.ID}, err
+	}
+	if marker != nil {
+		return MigrationResult{ID: migration.ID, Skipped: true}, nil
+	}
+
+	result, err := s.applyMigration(ctx, migration, false, lease, progress, logger)
+	if err != nil {
+		return result, err
+	}
+
+	if result.Failed > 0 {
+		logger.Warn("Migration is not marked applied, some keys failed",
+			slog.String("migration", migration.ID),
+			slog.Int64("migrated", result.Migrated),
+			slog.Int64("failed", result.Failed),
+		)
+		return result, nil
+	}
+
+	value, _ := json.Marshal(migrationMarker{AppliedAt: time.Now(), Migrated: result.Migrated})
+	if err := s.storage.Save(ctx, s.migrationKey(migration.ID), value, migrationMarkerTTL); err != nil {
+		return result, err
+	}
+
+	logger.Info("Migration applied", slog.String("migration", migration.ID), slog.Int64("migrated", result.Migrated))
+
+	return result, nil
+}
+
+// MigrateCache re-keys the entries of an older key version, whether or
+// not its migration was applied.
+func (s ProxyService) MigrateCache(ctx context.Context, fromVersion int, logger *slog.Logger) (int64, error) {
+	return s.migrateCache(ctx, fromVersion, discardProgress{}, logger)
+}
+
+func (s ProxyService) migrateCache(ctx context.Context, fromVersion int, progress progress, logger *slog.Logger) (int64, error) {
+	if fromVersion < legacyKeyVersion || fromVersion >= s.config.KeyVersion {
+		return 0, ErrInvalidVersion
+	}
+
+	var migrated int64
+	for _, migration := range s.keyMigrations(fromVersion) {
+		result, err := s.applyMigration(ctx, migration, false, nil, progress, logger)
+		migrated += result.Migrated
+		if err != nil {
+			return migrated, err
+		}
+	}
+
+	return migrated, nil
+}
+
+// applyMigration re-keys the entries of a migration, extending lease
+// after every batch when it is set.
+func (s ProxyService) applyMigration(ctx context.Context, migration Migration, dryRun bool, lease *migrationLease, progress progress, logger *slog.Logger) (MigrationResult, error) {
+	logger = logger.With(slog.String("migration", migration.ID), slog.Bool("dry_run", dryRun))
+
+	result := MigrationResult{ID: migration.ID, DryRun: dryRun}
+	fail := func(key string, err error) {
+		logger.Error("Cannot migrate key", slog.String("key", key), slog.String("error", err.Error()))
+		result.Failed++
+		progress.fail(ctx, key, err)
+	}
+
+	err := s.storage.ScanKeys(ctx, migration.Match, s.config.ScanCount, func(keys []string) error {
+		for _, key := range keys {
+			result.Matched++
+
+			value, err := s.storage.Read(ctx, key)
+			if err != nil {
+				fail(key, err)
+				continue
+			}
+
+			stringValue, ok := value.(string)
+			if !ok {
+				fail(key, ErrValueNotString)
+				continue
+			}
+
+			newKey, path, err := migration.Transform(key, stringValue)
+			if err != nil {
+				fail(key, err)
+				continue
+			}
+			if newKey == "" {
+				continue
+			}
+
+			if dryRun {
+				result.Migrated++
+				continue
+			}
+
+			ttl, err := s.storage.TTL(ctx, key)
+			if errors.Is(err, storage.ErrKeyNotFound) {
+				continue
+			}
+			if err != nil {
+				fail(key, err)
+				continue
+			}
+			// A moved key keeps the time it had left; the policy only
+			// applies to keys that never expire.
+			if ttl <= 0 {
+				ttl = s.keyTTL(newKey, path)
+			}
+
+			err = s.storage.Save(ctx, newKey, stringValue, ttl)
+			if err != nil {
+				fail(key, err)
+				continue
+			}
+
+			if _, err := s.storage.Delete(ctx, key); err != nil {
+				logger.Warn("Cannot delete migrated key", slog.String("key", key), slog.String("error", err.Error()))
+			}
+
+			result.Migrated++
+		}
+
+		progress.advance(ctx, int64(len(keys)))
+
+		logger.Info("Migrated keys batch",
+			slog.Int("batch", len(keys)),
+			slog.Int64("migrated", result.Migrated),
+		)
+
+		return lease.extend(ctx)
+	})
+
+	return result, err
+}
+
+func (s ProxyService) migrationMarker(ctx context.Context, id string) (*migrationMarker, error) {
+	value, err := s.storage.Read(ctx, s.migrationKey(id))
+	if errors.Is(err, storage.ErrKeyNotFound) || (err == nil && value == nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	stringValue, ok := value.(string)
+	if !ok {
+		return nil, ErrValueNotString
+	}
+
+	var marker migrationMarker
+	if err := json.Unmarshal([]byte(stringValue), &marker); err != nil {
+		return nil, err
+	}
+
+	return &marker, nil
+}
+
+// migrationLease is held by the instance applying a migration.
+type migrationLease struct {
+	service ProxyService
+	key     string
+	token   string
+}
+
+// acquireMigrationLease takes the lease of a migration, or returns
+// ErrMigrationLocked while another instance holds it.
+func (s ProxyService) acquireMigrationLease(ctx context.Context, id string) (*migrationLease, error) {
+	token, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+
+	lease := &migrationLease{service: s, key: s.migrationKey(id) + migrationLeaseSuffix, token: token}
+
+	acquired, err := s.storage.SaveIfAbsent(ctx, lease.key, token, migrationLeaseTTL)
+	if err != nil {
+		return nil, err
+	}
+	if !acquired {
+		return nil, fmt.Errorf("%w: %s", ErrMigrationLocked, id)
+	}
+
+	return lease, nil
+}
+
+// extend renews the lease, and fails when it expired and may be held
+// by another instance. A nil lease is not extended.
+func (l *migrationLease) extend(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	extended, err := l.service.storage.CompareAndSwap(ctx, l.key, l.token, l.token, migrationLeaseTTL)
+	if err != nil {
+		return err
+	}
+	if !extended {
+		return ErrMigrationLeaseLost
+	}
+
+	return nil
+}
+
+// release frees the lease unless it was lost meanwhile.
+func (l *migrationLease) release(ctx context.Context, logger *slog.Logger) {
+	if l.extend(ctx) != nil {
+		return
+	}
+
+	if _, err := l.service.storage.Delete(ctx, l.key); err != nil {
+		logger.Warn("Cannot release migration lease", slog.String("key", l.key), slog.String("error", err.Error()))
+	}
+}
+
+// migrationKey lives outside the versioned cache namespace and is
+// skipped by the key migrations.
+func (s ProxyService) migrationKey(id string) string {
+	return s.config.KeyPrefix + migrationsSegment + id
+}
+
+// keyMigrations returns the migrations that move the keys of an older
+// version into the current namespace. Keys that do not look like the
+// proxy's own are skipped and left in place.
+//
+// The keys of a version older than normalizedKeyVersion hash the query as
+// sent, so once the current version normalises the queries they are only
+// moved when their query can be restored and re-keyed: the cleaned
+// addresses, from their "source" field. The other keys stay until they
+// expire.
+func (s ProxyService) keyMigrations(fromVersion int) []Migration {
+	namespace := s.keyNamespace(s.config.KeyVersion)
+	rekey := fromVersion < normalizedKeyVersion && s.config.KeyVersion >= normalizedKeyVersion
+
+	// move returns the new key of segmentKey, an unprefixed
+	// "<segment>:<hash>" key, or an empty one to leave it in place.
+	move := func(key string, segmentKey string, value string) (string, string, error) {
+		path, ok := s.segmentPath(segmentKey)
+		if !ok {
+			return "", "", fmt.Errorf("cannot restore path from key %s", key)
+		}
+
+		if !rekey {
+			return namespace + segmentKey, path, nil
+		}
+
+		if path != sourcePath {
+			return "", "", nil
+		}
+
+		newKey, err := s.sourceKey(value)
+		if err != nil || newKey == "" {
+			return "", "", err
+		}
+		if strings.HasSuffix(segmentKey, staleSuffix) {
+			newKey = s.staleKey(newKey)
+		}
+
+		return newKey, path, nil
+	}
+
+	if fromVersion != legacyKeyVersion {
+		oldNamespace := s.keyNamespace(fromVersion)
+
+		match := storage.EscapePattern(oldNamespace) + "*"
+		if rekey {
+			match = storage.EscapePattern(oldNamespace+s.pathSegment(sourcePath)+":") + "*"
+		}
+
+		return []Migration{{
+			ID:    fmt.Sprintf("namespace-v%d", fromVersion),
+			Match: match,
+			Transform: func(key string, value string) (string, string, error) {
+				return move(key, strings.TrimPrefix(key, oldNamespace), value)
+			},
+		}}
+	}
+
+	// Bare hashes carry no path, so only cleaned addresses can be
+	// re-keyed: their query is restored from the "source" field. Other
+	// bare hashes stay until they expire; their "<segment>:<hash>"
+	// copies are migrated below.
+	migrations := []Migration{{
+		ID:    "legacy-hash-keys",
+		Match: legacyHashMatch,
+		Transform: func(key string, value string) (string, string, error) {
+			if !isHash(key) {
+				return "", "", nil
+			}
+
+			newKey, err := s.sourceKey(value)
+			if err != nil || newKey == "" {
+				return "", "", err
+			}
+
+			return newKey, sourcePath, nil
+		},
+	}}
+
+	for _, segment := range keySegments {
+		if rekey && !strings.HasPrefix(s.pathSegment(sourcePath), segment+":") {
+			continue
+		}
+
+		migrations = append(migrations, Migration{
+			ID:    "segment-keys-" + segment,
+			Match: storage.EscapePattern(segment+":") + "*",
+			Transform: func(key string, value string) (string, string, error) {
+				index := strings.LastIndex(key, ":")
+				if index <= len(segment) || !isHash(key[index+1:]) {
+					return "", "", nil
+				}
+
+				return move(key, key, value)
+			},
+		})
+	}
+
+	return migrations
+}
+
+// sourceKey returns the current key of a cleaned address value, derived
+// from its "source" field, or an empty one when the value has none.
+func (s ProxyService) sourceKey(value string) (string, error) {
+	var structValue dadata.DaDataClean
+	if err := json.Unmarshal([]byte(value), &structValue); err != nil || len(structValue) < 1 {
+		return "", nil
+	}
+
+	source, ok := structValue[0]["source"].(string)
+	if !ok {
+		return "", nil
+	}
+
+	query, err := json.Marshal([]string{source})
+	if err != nil {
+		return "", err
+	}
+
+	normalized, err := s.normalizeQuery(sourcePath, string(query))
+	if err != nil {
+		return "", err
+	}
+
+	return s.makeKey(sourcePath, normalized), nil
+}
@@ -0,0 +1,133 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/ilazutin/dadataproxy_go/internal/config"
+	"github.com/ilazutin/dadataproxy_go/internal/service/dadata"
+)
+
+// queryField holds the query text of an object query.
+const queryField = "query"
+
+// normalizeQuery returns the query the cache key of path is derived from:
+// compact JSON with sorted object keys, rewritten by the normalisation
+// configured for path. The upstream request keeps the original query.
+func (s ProxyService) normalizeQuery(path string, data string) (string, error) {
+	var query interface{}
+	err := json.Unmarshal([]byte(data), &query)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrInvalidQuery, err)
+	}
+
+	query = normalizeValue(matchRoute(s.config.Normalize, path), query)
+
+	queryString, err := json.Marshal(query)
+	if err != nil {
+		return "", err
+	}
+
+	buffer := new(bytes.Buffer)
+	err = json.Compact(buffer, queryString)
+	if err != nil {
+		return "", err
+	}
+
+	return buffer.String(), nil
+}
+
+// normalizeValue normalises the query texts of value only: a top level
+// string, the strings of the top level array and the query field of the
+// top level object. Other strings, such as filters or the fields of a
+// structured query, are values DaData matches exactly and are kept as
+// they are. Parameters are dropped from the top level object only.
+func normalizeValue(normalization config.Normalization, value interface{}) interface{} {
+	switch value := value.(type) {
+	case string:
+		return normalizeString(normalization, value)
+	case []interface{}:
+		for index, item := range value {
+			if text, ok := item.(string); ok {
+				value[index] = normalizeString(normalization, text)
+			}
+		}
+		return value
+	case map[string]interface{}:
+		for name, item := range value {
+			if dropParam(normalization, name, item) {
+				delete(value, name)
+				continue
+			}
+			if text, ok := item.(string); ok && name == queryField {
+				value[name] = normalizeString(normalization, text)
+			}
+		}
+		return value
+	default:
+		return value
+	}
+}
+
+func dropParam(normalization config.Normalization, name string, value interface{}) bool {
+	for _, drop := range normalization.Drop {
+		if drop == name {
+			return true
+		}
+	}
+
+	defaultValue, ok := normalization.Defaults[name]
+
+	return ok && fmt.Sprint(value) == defaultValue
+}
+
+func normalizeString(normalization config.Normalization, value string) string {
+	if normalization.Case {
+		value = strings.ToLower(value)
+	}
+
+	if normalization.Yo {
+		value = strings.NewReplacer("ё", "е", "Ё", "Е").Replace(value)
+	}
+
+	if normalization.Punctuation {
+		value = strings.Map(func(r rune) rune {
+			if unicode.IsPunct(r) {
+				return ' '
+			}
+			return r
+		}, value)
+	}
+
+	if normalization.Whitespace {
+		value = strings.Join(strings.Fields(value), " ")
+	}
+
+	return value
+}
+
+// withSources returns a copy of result whose items carry the source the
+// client sent: a cached result is shared by every query normalised the
+// same way and holds the source of the query that filled it.
+func withSources(result dadata.DaDataClean, queries []json.RawMessage) dadata.DaDataClean {
+	restored := make(dadata.DaDataClean, len(result))
+	for index, item := range result {
+		restored[index] = item
+
+		var source string
+		if _, ok := item["source"]; !ok || index >= len(queries) || json.Unmarshal(queries[index], &source) != nil {
+			continue
+		}
+
+		restored[index] = make(map[string]interface{}, len(item))
+		for name, value := range item {
+			restored[index][name] = value
+		}
+		restored[index]["source"] = source
+	}
+
+	return restored
+}
@@ -0,0 +1,37 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+
+	"github.com/ilazutin/dadataproxy_go/internal/config"
+)
+
+// PassthroughValue forwards a request for a configured route to DaData as
+// is. The cache key is derived from the method, the canonical query
+// string and data, the normalised query; the upstream receives the
+// original body and query string.
+func (s ProxyService) PassthroughValue(ctx context.Context, route config.PassthroughRoute, method string, path string, rawQuery string, body string, data string, ignoreCache bool, logger *slog.Logger) (*json.RawMessage, bool, error) {
+	p := newPipeline(s, func(ctx context.Context, path string, _ string) (*json.RawMessage, error) {
+		return s.dadata.Forward(ctx, route.Host, method, path, rawQuery, body)
+	})
+
+	// The method and the query string select different responses, so
+	// both are a part of the key next to the normalised body.
+	p.key = func(path string, query string) string {
+		return s.makeKey(path, method+"\n"+rawQuery+"\n"+query)
+	}
+
+	if !route.Cache {
+		p.policy = func(string) config.CachePolicy {
+			return config.CachePolicy{Disabled: true}
+		}
+	}
+
+	if data == "" {
+		data = "{}"
+	}
+
+	return p.run(ctx, path, data, ignoreCache, logger)
+}
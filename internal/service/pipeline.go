@@ -0,0 +1,118 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+
+	"github.com/ilazutin/dadataproxy_go/internal/config"
+)
+
+// pipeline is the read-cache, call-upstream, save-result flow shared by
+// all cached DaData endpoints. Every step can be replaced per endpoint.
+type pipeline[T any] struct {
+	service ProxyService
+	key     func(path string, query string) string
+	policy  func(path string) config.CachePolicy
+	decode  func(value string) (*T, error)
+	fetch   func(ctx context.Context, path string, query string) (*T, error)
+}
+
+func newPipeline[T any](s ProxyService, fetch func(ctx context.Context, path string, query string) (*T, error)) pipeline[T] {
+	return pipeline[T]{
+		service: s,
+		key:     s.makeKey,
+		policy:  s.policy,
+		decode:  decodeJSON[T],
+		fetch:   fetch,
+	}
+}
+
+// run returns the result for the query, and whether it is a stale copy
+// served because the upstream call failed.
+func (p pipeline[T]) run(ctx context.Context, path string, data string, ignoreCache bool, logger *slog.Logger) (*T, bool, error) {
+	s := p.service
+
+	queryString, err := s.normalizeQuery(path, data)
+	if err != nil {
+		return nil, false, err
+	}
+
+	storageKey := p.key(path, queryString)
+	policy := p.policy(path)
+	endpoint := s.usageEndpoint(ctx, path)
+
+	logger = logger.With(
+		slog.String("path", path),
+		slog.String("query", queryString),
+		slog.String("key", storageKey),
+	)
+
+	if !ignoreCache && !policy.Disabled {
+		if res, ok := p.readCache(ctx, storageKey, logger); ok {
+			logger.Info("Get from cache")
+			s.usage.hit(endpoint)
+			return res, false, nil
+		}
+	}
+
+	value, shared, err := s.inflight.do(ctx, storageKey, func(ctx context.Context) (interface{}, error) {
+		s.usage.call(endpoint)
+		return p.fetch(ctx, path, data)
+	})
+	if shared {
+		logger.Info("Upstream call collapsed", slog.Uint64("collapsed_total", s.inflight.Collapsed()))
+	}
+	if err != nil {
+		logger.Error("Get value from dadata api", slog.String("error", err.Error()))
+
+		if ctx.Err() != nil {
+			return nil, false, err
+		}
+
+		if staleValue, ok := s.readFallback(ctx, storageKey, policy, err, logger); ok {
+			if res, err := p.decode(staleValue); err == nil {
+				return res, true, nil
+			}
+		}
+
+		return nil, false, err
+	}
+
+	result := value.(*T)
+	if shared || policy.Disabled {
+		return result, false, nil
+	}
+
+	encodingResult, _ := json.Marshal(result)
+	go s.saveResult(context.WithoutCancel(ctx), storageKey, encodingResult, policy)
+
+	return result, false, nil
+}
+
+func (p pipeline[T]) readCache(ctx context.Context, storageKey string, logger *slog.Logger) (*T, bool) {
+	storagedValue, err := p.service.storage.Read(ctx, storageKey)
+	if err != nil || storagedValue == nil {
+		if err != nil {
+			logger.Info("Key not found in cache", slog.String("error", err.Error()))
+		} else {
+			logger.Info("Key not found in cache")
+		}
+		return nil, false
+	}
+
+	res, err := p.decode(storagedValue.(string))
+	if err != nil {
+		logger.Error("Decode cached value", slog.String("error", err.Error()))
+		return nil, false
+	}
+
+	return res, true
+}
+
+func decodeJSON[T any](value string) (*T, error) {
+	var res *T
+	err := json.Unmarshal([]byte(value), &res)
+
+	return res, err
+}
@@ -0,0 +1,65 @@
+package service
+
+import (
+	"path"
+	"strings"
+
+	"github.com/ilazutin/dadataproxy_go/internal/config"
+)
+
+// policy returns the cache policy of the most specific route pattern
+// matching urlPath. A zero TTL means the storage default expiration.
+func (s ProxyService) policy(urlPath string) config.CachePolicy {
+	return matchRoute(s.config.Policies, urlPath)
+}
+
+// price returns the configured upstream price of one request to urlPath.
+func (s ProxyService) price(urlPath string) float64 {
+	return matchRoute(s.config.Pricing, urlPath)
+}
+
+// matchRoute returns the value of the most specific route pattern
+// matching urlPath, or the zero value when none matches.
+func matchRoute[T any](routes map[string]T, urlPath string) T {
+	pattern, ok := matchPattern(routes, urlPath)
+	if !ok {
+		var zero T
+		return zero
+	}
+
+	return routes[pattern]
+}
+
+// matchPattern returns the most specific route pattern matching urlPath.
+func matchPattern[T any](routes map[string]T, urlPath string) (string, bool) {
+	urlPath = routePath(urlPath)
+
+	if _, ok := routes[urlPath]; ok {
+		return urlPath, true
+	}
+
+	var (
+		result  string
+		longest = -1
+	)
+	for pattern := range routes {
+		matched, err := path.Match(pattern, urlPath)
+		if err != nil || !matched {
+			continue
+		}
+		if len(pattern) > longest {
+			result = pattern
+			longest = len(pattern)
+		}
+	}
+
+	return result, longest >= 0
+}
+
+func routePath(urlPath string) string {
+	if !strings.HasPrefix(urlPath, "/") {
+		return "/" + urlPath
+	}
+
+	return urlPath
+}
@@ -1,296 +1,298 @@
 package service
 
 import (
-	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"reflect"
 
+	"github.com/ilazutin/dadataproxy_go/internal/config"
 	"github.com/ilazutin/dadataproxy_go/internal/service/dadata"
 	"github.com/ilazutin/dadataproxy_go/internal/storage"
 )
 
+const (
+	jobsSegment       = ":jobs:"
+	migrationsSegment = ":migrations:"
+)
+
+var (
+	ErrEmptyPath = errors.New("path is required")
+	// ErrInvalidQuery is returned for a query the proxy cannot read; it
+	// is the client's mistake and never reaches DaData.
+	ErrInvalidQuery = errors.New("invalid query")
+)
+
 type ProxyService struct {
-	dadata  *dadata.DaData
-	storage storage.Storage
-	logger  *slog.Logger
+	dadata   *dadata.DaData
+	storage  storage.Storage
+	config   config.Cache
+	inflight *flightGroup
+	usage    *usageCounter
+	jobs     *jobRunner
+	registry *migrationRegistry
+	logger   *slog.Logger
 }
 
-func New(dadata *dadata.DaData, storage storage.Storage, logger *slog.Logger) *ProxyService {
-	return &ProxyService{
-		dadata:  dadata,
-		storage: storage,
-		logger:  logger,
+func New(dadata *dadata.DaData, storage storage.Storage, config config.Cache, logger *slog.Logger) *ProxyService {
+	s := &ProxyService{
+		dadata:   dadata,
+		storage:  storage,
+		config:   config,
+		inflight: newFlightGroup(),
+		usage:    newUsageCounter(),
+		jobs:     newJobRunner(),
+		registry: &migrationRegistry{},
+		logger:   logger,
 	}
+	s.registerKeyMigrations()
+
+	return s
 }
 
-func (s ProxyService) CleanValue(path string, data string, ignoreCache bool, logger *slog.Logger) (*dadata.DaDataClean, error) {
+// ControlKeyPrefixes returns the prefixes of the job records and the
+// migration markers, which instances change concurrently and so must be
+// read from the shared storage rather than a local copy.
+func ControlKeyPrefixes(config config.Cache) []string {
+	return []string{config.KeyPrefix + jobsSegment, config.KeyPrefix + migrationsSegment}
+}
 
-	queryString, err := s.formatQuery(data)
-	if err != nil {
-		return nil, err
+func (s ProxyService) CleanValue(ctx context.Context, path string, data string, ignoreCache bool, logger *slog.Logger) (*dadata.DaDataClean, bool, error) {
+	result, stale, err := newPipeline(s, s.dadata.GetCleanValue).run(ctx, path, data, ignoreCache, logger)
+	if err != nil || result == nil {
+		return result, stale, err
 	}
 
-	storageKey := s.makeHash(path, queryString)
-
-	if !ignoreCache {
-		storagedValue, err := s.storage.Read(storageKey)
-		if err != nil {
-			logger.Info("Key not found in cache",
-				slog.String("path", path),
-				slog.String("query", queryString),
-				slog.String("key", storageKey),
-				slog.String("error", err.Error()),
-			)
-		}
-		if storagedValue == nil {
-			logger.Info("Key not found in cache",
-				slog.String("path", path),
-				slog.String("query", queryString),
-				slog.String("key", storageKey),
-			)
-		} else {
-			var res *dadata.DaDataClean
-			err := json.Unmarshal([]byte(storagedValue.(string)), &res)
-			if err != nil {
-				logger.Error("Decode cached value", slog.String("error", err.Error()))
-			}
-
-			logger.Info("Get from cache",
-				slog.String("path", path),
-				slog.String("query", queryString),
-				slog.String("key", storageKey))
-
-			return res, nil
-		}
+	var queries []json.RawMessage
+	if json.Unmarshal([]byte(data), &queries) == nil {
+		restored := withSources(*result, queries)
+		result = &restored
 	}
 
-	result, err := s.dadata.GetCleanValue(path, queryString)
-	if err != nil {
-		logger.Error("Get value from dadata api", slog.String("query", queryString))
-		return nil, err
-	}
+	return result, stale, nil
+}
 
-	encodingResult, _ := json.Marshal(result)
-	go s.storage.Save(storageKey, encodingResult)
+func (s ProxyService) SuggestValue(ctx context.Context, path string, data string, ignoreCache bool, logger *slog.Logger) (*dadata.DaDataSuggest, bool, error) {
+	return newPipeline(s, s.dadata.GetSuggestValue).run(ctx, path, data, ignoreCache, logger)
+}
 
-	return result, nil
+func (s ProxyService) IpLocateValue(ctx context.Context, path string, data string, ignoreCache bool, logger *slog.Logger) (*dadata.DaDataIpLocate, bool, error) {
+	return newPipeline(s, s.dadata.GetIpLocateValue).run(ctx, path, data, ignoreCache, logger)
 }
 
-func (s ProxyService) SuggestValue(path string, data string, ignoreCache bool, logger *slog.Logger) (*dadata.DaDataSuggest, error) {
+func (s ProxyService) SaveToCache(ctx context.Context, path string, query interface{}, body interface{}, logger *slog.Logger) error {
 
-	queryString, err := s.formatQuery(data)
+	queryString, err := json.Marshal(query)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	storageKey := s.makeHash(path, queryString)
+	normalized, err := s.normalizeQuery(path, string(queryString))
+	if err != nil {
+		return err
+	}
 
-	if !ignoreCache {
-		storagedValue, err := s.storage.Read(storageKey)
+	storageKey := s.makeKey(path, normalized)
+
+	var encodingResult []byte
+	if reflect.TypeOf(body).Kind() == reflect.String {
+		encodingResult = []byte(body.(string))
+	} else {
+		encodingResult, err = json.Marshal(body)
 		if err != nil {
-			logger.Info("Key not found in cache",
-				slog.String("path", path),
-				slog.String("query", queryString),
-				slog.String("key", storageKey),
-				slog.String("error", err.Error()),
-			)
-		}
-		if storagedValue == nil {
-			logger.Info("Key not found in cache",
-				slog.String("path", path),
-				slog.String("query", queryString),
-				slog.String("key", storageKey),
-			)
-		} else {
-			var res *dadata.DaDataSuggest
-			err := json.Unmarshal([]byte(storagedValue.(string)), &res)
-			if err != nil {
-				logger.Error("Decode cached value", slog.String("error", err.Error()))
-			}
-
-			logger.Info("Get from cache",
-				slog.String("path", path),
-				slog.String("query", queryString),
-				slog.String("key", storageKey),
-			)
-
-			return res, nil
+			return err
 		}
 	}
 
-	result, err := s.dadata.GetSuggestValue(path, queryString)
-	if err != nil {
-		logger.Error("Get value from dadata api", slog.String("query", queryString))
-		return nil, err
-	}
-
-	encodingResult, _ := json.Marshal(result)
-	go s.storage.Save(storageKey, encodingResult)
+	err = s.storage.Save(ctx, storageKey, encodingResult, s.policy(path).TTL)
+	logger.Info("Key save to cache",
+		slog.String("key", storageKey),
+		slog.String("path", path),
+		slog.String("query", string(queryString)),
+		slog.String("body", string(encodingResult)[0:20]+"..."),
+	)
 
-	return result, nil
+	return err
 }
 
-func (s ProxyService) IpLocateValue(path string, data string, ignoreCache bool, logger *slog.Logger) (*dadata.DaDataIpLocate, error) {
-
-	queryString, err := s.formatQuery(data)
+func (s ProxyService) DeleteKeys(ctx context.Context, keys []string, logger *slog.Logger) (int64, error) {
+	deleted, err := s.storage.Delete(ctx, keys...)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 
-	storageKey := s.makeHash(path, queryString)
+	logger.Info("Keys deleted from cache", slog.Int("requested", len(keys)), slog.Int64("deleted", deleted))
 
-	if !ignoreCache {
-		storagedValue, err := s.storage.Read(storageKey)
-		if err != nil {
-			logger.Info("Key not found in cache",
-				slog.String("path", path),
-				slog.String("query", queryString),
-				slog.String("key", storageKey),
-				slog.String("error", err.Error()),
-			)
-		}
-		if storagedValue == nil {
-			logger.Info("Key not found in cache",
-				slog.String("path", path),
-				slog.String("query", queryString),
-				slog.String("key", storageKey),
-			)
-		} else {
-			var res *dadata.DaDataIpLocate
-			err := json.Unmarshal([]byte(storagedValue.(string)), &res)
-			if err != nil {
-				logger.Error("Decode cached value", slog.String("error", err.Error()))
-			}
-
-			logger.Info("Get from cache",
-				slog.String("path", path),
-				slog.String("query", queryString),
-				slog.String("key", storageKey),
-			)
-
-			return res, nil
-		}
-	}
+	return deleted, nil
+}
 
-	result, err := s.dadata.GetIpLocateValue(path, queryString)
+func (s ProxyService) DeleteFromCache(ctx context.Context, path string, query interface{}, logger *slog.Logger) (int64, error) {
+	queryString, err := json.Marshal(query)
 	if err != nil {
-		logger.Error("Get value from dadata api", slog.String("query", queryString))
-		return nil, err
+		return 0, err
 	}
 
-	encodingResult, _ := json.Marshal(result)
-	go s.storage.Save(storageKey, encodingResult)
-
-	return result, nil
-}
-
-func (s ProxyService) SaveToCache(path string, query interface{}, body interface{}, logger *slog.Logger) error {
-
-	queryString, err := json.Marshal(query)
+	normalized, err := s.normalizeQuery(path, string(queryString))
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	storageKey := s.makeHash(path, string(queryString))
+	storageKey := s.makeKey(path, normalized)
 
-	var encodingResult []byte
-	if reflect.TypeOf(body).Kind() == reflect.String {
-		encodingResult = []byte(body.(string))
-	} else {
-		encodingResult, err = json.Marshal(body)
-		if err != nil {
-			return err
-		}
+	deleted, err := s.storage.Delete(ctx, storageKey, s.staleKey(storageKey))
+	if err != nil {
+		return 0, err
 	}
 
-	err = s.storage.Save(storageKey, encodingResult)
-	logger.Info("Key save to cache",
+	logger.Info("Key deleted from cache",
 		slog.String("key", storageKey),
 		slog.String("path", path),
 		slog.String("query", string(queryString)),
-		slog.String("body", string(encodingResult)[0:20]+"..."),
+		slog.Int64("deleted", deleted),
 	)
 
-	return err
+	return deleted, nil
 }
 
-func (s ProxyService) MigrateCache(logger *slog.Logger) error {
+func (s ProxyService) DeleteByPath(ctx context.Context, path string, logger *slog.Logger) (int64, error) {
+	return s.deleteByPath(ctx, path, discardProgress{}, logger)
+}
 
-	keys, err := s.storage.ReadAllKeys()
-	if err != nil {
+func (s ProxyService) deleteByPath(ctx context.Context, path string, progress progress, logger *slog.Logger) (int64, error) {
+	segment := s.pathSegment(path)
+	if segment == "" {
+		return 0, ErrEmptyPath
+	}
+
+	var deleted int64
+	err := s.storage.ScanKeys(ctx, storage.EscapePattern(s.keyNamespace(s.config.KeyVersion)+segment+":")+"*", s.config.ScanCount, func(keys []string) error {
+		count, err := s.storage.Delete(ctx, keys...)
+		deleted += count
+		progress.advance(ctx, int64(len(keys)))
 		return err
+	})
+
+	logger.Info("Path deleted from cache", slog.String("path", path), slog.Int64("deleted", deleted))
+
+	return deleted, err
+}
+
+func (s ProxyService) saveResult(ctx context.Context, storageKey string, value []byte, policy config.CachePolicy) {
+	err := s.storage.Save(ctx, storageKey, value, policy.TTL)
+	if err != nil || !policy.Stale {
+		return
 	}
 
-	const path = "/clean/address"
+	s.storage.Save(ctx, s.staleKey(storageKey), value, policy.StaleTTL)
+}
 
-	for _, key := range keys {
-		value, err := s.storage.Read(key)
-		if err != nil {
-			logger.Error("Cannot convert key's value",
-				slog.String("key", key),
-				slog.String("value", value.(string)),
-				slog.String("error", err.Error()),
-			)
-			continue
+// readFallback returns the cached value to answer with when DaData
+// fails with err: the stale copy when the policy keeps one or, for a
+// request rate limited in cache mode, any cached copy of the key.
+func (s ProxyService) readFallback(ctx context.Context, storageKey string, policy config.CachePolicy, err error, logger *slog.Logger) (string, bool) {
+	if errors.Is(err, dadata.ErrRateLimited) {
+		if !s.dadata.CacheOnlyWhenLimited() || policy.Disabled {
+			return "", false
 		}
 
-		var structValue dadata.DaDataClean
-		err = json.Unmarshal([]byte(value.(string)), &structValue)
-		if err != nil {
-			logger.Error("Cannot convert key's value",
-				slog.String("key", key),
-				slog.String("value", value.(string)),
-				slog.String("error", err.Error()),
-			)
-			continue
+		if value, err := s.storage.Read(ctx, storageKey); err == nil && value != nil {
+			logger.Warn("Serve cached value, rate limited", slog.String("key", storageKey))
+			return value.(string), true
 		}
 
-		if len(structValue) < 1 {
-			logger.Error("Key is empty",
-				slog.String("key", key),
-				slog.String("value", value.(string)),
-			)
-			continue
-		}
+		policy.Stale = true
+	}
+
+	return s.readStale(ctx, storageKey, policy, logger)
+}
 
-		firstValue := structValue[0]
+func (s ProxyService) readStale(ctx context.Context, storageKey string, policy config.CachePolicy, logger *slog.Logger) (string, bool) {
+	if !policy.Stale || policy.Disabled {
+		return "", false
+	}
+
+	staleKey := s.staleKey(storageKey)
 
-		s.SaveToCache(path, []string{firstValue["source"].(string)}, value, logger)
+	value, err := s.storage.Read(ctx, staleKey)
+	if err != nil || value == nil {
+		return "", false
 	}
 
-	return nil
+	logger.Warn("Serve stale value from cache", slog.String("key", staleKey))
+
+	return value.(string), true
 }
 
-func (s ProxyService) makeHash(values ...string) string {
-	h := sha256.New()
-	for _, value := range values {
-		io.WriteString(h, value)
+type UpstreamStatus struct {
+	Breakers []dadata.BreakerStatus `json:"breakers"`
+	Limits   []dadata.LimitStatus   `json:"limits"`
+	Keys     []dadata.KeyStatus     `json:"keys"`
+}
+
+func (s ProxyService) UpstreamStatus() UpstreamStatus {
+	return UpstreamStatus{
+		Breakers: s.dadata.Breakers(),
+		Limits:   s.dadata.Limits(),
+		Keys:     s.dadata.Keys(),
+	}
+}
+
+func (s ProxyService) CacheStats() map[string]storage.TierStats {
+	reporter, ok := s.storage.(storage.StatsReporter)
+	if !ok {
+		return map[string]storage.TierStats{}
 	}
 
-	return fmt.Sprintf("%x", h.Sum(nil))
+	return reporter.Stats()
 }
 
-func (s ProxyService) formatQuery(data string) (string, error) {
-	var query interface{}
-	err := json.Unmarshal([]byte(data), &query)
-	if err != nil {
-		return "", err
+// UsageStats puts the upstream account state next to the proxy's own
+// counters. Upstream failures are reported in Errors, so the counters
+// are available even when DaData is not.
+type UsageStats struct {
+	Balance   *dadata.DaDataBalance        `json:"balance,omitempty"`
+	Daily     *dadata.DaDataDailyStats     `json:"daily,omitempty"`
+	Endpoints map[string]EndpointUsage     `json:"endpoints"`
+	Collapsed uint64                       `json:"collapsed"`
+	Cache     map[string]storage.TierStats `json:"cache"`
+	Errors    []string                     `json:"errors,omitempty"`
+}
+
+// UsageStats returns the usage for date (YYYY-MM-DD), or for today when
+// date is empty.
+func (s ProxyService) UsageStats(ctx context.Context, date string, logger *slog.Logger) UsageStats {
+	stats := UsageStats{
+		Endpoints: s.usage.snapshot(s.price),
+		Collapsed: s.inflight.Collapsed(),
+		Cache:     s.CacheStats(),
 	}
 
-	queryString, err := json.Marshal(query)
+	balance, err := s.dadata.GetBalance(ctx)
 	if err != nil {
-		return "", err
+		logger.Error("Get balance from dadata api", slog.String("error", err.Error()))
+		stats.Errors = append(stats.Errors, err.Error())
 	}
+	stats.Balance = balance
 
-	buffer := new(bytes.Buffer)
-	err = json.Compact(buffer, queryString)
+	daily, err := s.dadata.GetDailyStats(ctx, date)
 	if err != nil {
-		return "", err
+		logger.Error("Get daily stats from dadata api", slog.String("error", err.Error()))
+		stats.Errors = append(stats.Errors, err.Error())
 	}
+	stats.Daily = daily
 
-	return buffer.String(), nil
+	return stats
+}
+
+func (s ProxyService) makeHash(values ...string) string {
+	h := sha256.New()
+	for _, value := range values {
+		io.WriteString(h, value)
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil))
 }
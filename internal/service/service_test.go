@@ -1,14 +1,25 @@
 package service
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"net/http"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/ilazutin/dadataproxy_go/internal/config"
 	"github.com/ilazutin/dadataproxy_go/internal/service/dadata"
+	"github.com/ilazutin/dadataproxy_go/internal/storage"
+	"github.com/ilazutin/dadataproxy_go/internal/storage/memory"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -16,26 +27,118 @@ type ProxyServiceTestSuite struct {
 	suite.Suite
 
 	service *ProxyService
+	logger  *slog.Logger
 }
 
 type MockStorage struct{}
 
-func (st MockStorage) Save(string, interface{}) error {
+func (st MockStorage) Save(context.Context, string, interface{}, time.Duration) error {
 	return nil
 }
 
-func (st MockStorage) Read(string) (interface{}, error) {
+func (st MockStorage) Read(context.Context, string) (interface{}, error) {
 	return nil, nil
 }
 
-func (st MockStorage) ReadAllKeys() ([]string, error) {
-	return nil, nil
+func (st MockStorage) ScanKeys(context.Context, string, int64, func([]string) error) error {
+	return nil
+}
+
+func (st MockStorage) Delete(context.Context, ...string) (int64, error) {
+	return 0, nil
+}
+
+func (st MockStorage) SaveIfAbsent(context.Context, string, interface{}, time.Duration) (bool, error) {
+	return true, nil
+}
+
+func (st MockStorage) CompareAndSwap(context.Context, string, string, interface{}, time.Duration) (bool, error) {
+	return true, nil
+}
+
+func (st MockStorage) TTL(context.Context, string) (time.Duration, error) {
+	return 0, nil
+}
+
+// MockTransport answers cleaner requests with the cleaned source echoed
+// back, or with StatusCode when it is set.
+type MockTransport struct {
+	StatusCode int
+}
+
+func (t MockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.StatusCode != 0 {
+		return &http.Response{
+			StatusCode: t.StatusCode,
+			Body:       io.NopCloser(strings.NewReader(`{"message":"mock error"}`)),
+			Request:    req,
+		}, nil
+	}
+
+	var query []string
+	if err := json.NewDecoder(req.Body).Decode(&query); err != nil {
+		return nil, err
+	}
+
+	result := make(dadata.DaDataClean, 0, len(query))
+	for _, source := range query {
+		result = append(result, map[string]interface{}{"source": source, "result": strings.ToUpper(source)})
+	}
+	body, _ := json.Marshal(result)
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(bytes.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+// batchTransport records the body and the number of items of every
+// cleaner request.
+type batchTransport struct {
+	MockTransport
+
+	mu     sync.Mutex
+	sizes  []int
+	bodies []string
+}
+
+func (t *batchTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var query []string
+	if err := json.Unmarshal(body, &query); err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	t.sizes = append(t.sizes, len(query))
+	t.bodies = append(t.bodies, string(body))
+	t.mu.Unlock()
+
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return t.MockTransport.RoundTrip(req)
 }
 
 func (suite *ProxyServiceTestSuite) SetupTest() {
 	storageMock := MockStorage{}
-	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
-	suite.service = New(dadata.New("ComeAndGetYourOwnSecretKey", "ComeAndGetYourOwnSecretKey"), storageMock, logger)
+	suite.logger = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	suite.service = New(suite.newDaData(MockTransport{}), storageMock, config.Cache{}, suite.logger)
+}
+
+func (suite *ProxyServiceTestSuite) newDaData(transport http.RoundTripper) *dadata.DaData {
+	client, err := dadata.New(config.DaData{
+		Token:      "ComeAndGetYourOwnSecretKey",
+		SecretKey:  "ComeAndGetYourOwnSecretKey",
+		CleanUrl:   "https://cleaner.dadata.ru/api/v1",
+		SuggestUrl: "https://suggestions.dadata.ru/suggestions/api/4_1/rs",
+	}, transport, suite.logger)
+	suite.Require().NoError(err)
+
+	return client
 }
 
 func (suite *ProxyServiceTestSuite) TestKeepConnections() {
@@ -45,7 +148,7 @@ func (suite *ProxyServiceTestSuite) TestKeepConnections() {
 	}
 
 	for index, address := range addresses {
-		result, err := suite.service.CleanValue("clean/address", address, false, suite.service.logger)
+		result, _, err := suite.service.CleanValue(context.Background(), "clean/address", address, false, suite.service.logger)
 		suite.Require().NoError(err)
 		body, err := json.Marshal(result)
 		if err == nil {
@@ -55,6 +158,844 @@ func (suite *ProxyServiceTestSuite) TestKeepConnections() {
 	}
 }
 
+func (suite *ProxyServiceTestSuite) TestPolicy() {
+	suite.service.config.Policies = map[string]config.CachePolicy{
+		"/clean/*":          {TTL: time.Hour},
+		"/suggest/address":  {TTL: time.Minute},
+		"/suggest/*":        {TTL: time.Second},
+		"/iplocate/address": {Disabled: true},
+	}
+
+	suite.Equal(time.Hour, suite.service.policy("/clean/address").TTL)
+	suite.Equal(time.Hour, suite.service.policy("clean/phone").TTL)
+	suite.Equal(time.Minute, suite.service.policy("/suggest/address").TTL)
+	suite.Equal(time.Second, suite.service.policy("/suggest/party").TTL)
+	suite.True(suite.service.policy("/iplocate/address").Disabled)
+	suite.Equal(config.CachePolicy{}, suite.service.policy("/findById/party"))
+}
+
+func (suite *ProxyServiceTestSuite) TestDeleteByPath() {
+	st := memory.New(100, time.Hour, suite.service.logger)
+	proxy := New(suite.service.dadata, st, config.Cache{KeyPrefix: "dadataproxy", KeyVersion: 2, ScanCount: 10}, suite.service.logger)
+
+	suite.Require().NoError(st.Save(context.Background(), "dadataproxy:v2:clean:address:abc", `[]`, 0))
+	suite.Require().NoError(st.Save(context.Background(), "dadataproxy:v2:clean:phone:def", `[]`, 0))
+
+	deleted, err := proxy.DeleteByPath(context.Background(), "/clean/*", suite.service.logger)
+	suite.Require().NoError(err)
+	suite.Equal(int64(0), deleted)
+
+	deleted, err = proxy.DeleteByPath(context.Background(), "/clean/address", suite.service.logger)
+	suite.Require().NoError(err)
+	suite.Equal(int64(1), deleted)
+
+	_, err = st.Read(context.Background(), "dadataproxy:v2:clean:phone:def")
+	suite.NoError(err)
+}
+
+func (suite *ProxyServiceTestSuite) TestMigrateCache() {
+	st := memory.New(100, time.Hour, suite.service.logger)
+	proxy := New(suite.service.dadata, st, config.Cache{KeyPrefix: "dadataproxy", KeyVersion: 2, ScanMatch: "*", ScanCount: 10}, suite.service.logger)
+
+	legacyKey := proxy.makeHash("/clean/address", `["мск сухонская 11"]`)
+	suggestHash := proxy.makeHash("/suggest/address", `{"query":"мск"}`)
+	suite.Require().NoError(st.Save(context.Background(), legacyKey, `[{"source":"мск сухонская 11"}]`, time.Minute))
+	suite.Require().NoError(st.Save(context.Background(), suggestHash, `{"suggestions":[]}`, 0))
+	suite.Require().NoError(st.Save(context.Background(), "suggest:address:"+suggestHash, `{"suggestions":[]}`, 0))
+	suite.Require().NoError(st.Save(context.Background(), "suggest:address:abc", `{"suggestions":[]}`, 0))
+	suite.Require().NoError(st.Save(context.Background(), "session:user:42", `{}`, 0))
+	suite.Require().NoError(st.Save(context.Background(), "dadataproxy:v1:findById:party:def", `{"suggestions":[]}`, 0))
+
+	migrated, err := proxy.MigrateCache(context.Background(), legacyKeyVersion, suite.service.logger)
+	suite.Require().NoError(err)
+	suite.Equal(int64(2), migrated)
+
+	value, err := st.Read(context.Background(), proxy.makeKey("/clean/address", `["мск сухонская 11"]`))
+	suite.Require().NoError(err)
+	suite.Equal(`[{"source":"мск сухонская 11"}]`, value)
+
+	ttl, err := st.TTL(context.Background(), proxy.makeKey("/clean/address", `["мск сухонская 11"]`))
+	suite.Require().NoError(err)
+	suite.InDelta(time.Minute, ttl, float64(time.Second), "a migrated key keeps the time it had left")
+
+	_, err = st.Read(context.Background(), "dadataproxy:v2:suggest:address:"+suggestHash)
+	suite.Require().NoError(err)
+
+	for _, key := range []string{suggestHash, "suggest:address:abc", "session:user:42"} {
+		_, err = st.Read(context.Background(), key)
+		suite.NoError(err, "foreign key %s must stay", key)
+	}
+
+	migrated, err = proxy.MigrateCache(context.Background(), 1, suite.service.logger)
+	suite.Require().NoError(err)
+	suite.Equal(int64(1), migrated)
+
+	_, err = st.Read(context.Background(), "dadataproxy:v2:findById:party:def")
+	suite.Require().NoError(err)
+
+	_, err = proxy.MigrateCache(context.Background(), 2, suite.service.logger)
+	suite.ErrorIs(err, ErrInvalidVersion)
+}
+
+func (suite *ProxyServiceTestSuite) TestRunMigrations() {
+	st := memory.New(100, time.Hour, suite.service.logger)
+	proxy := New(suite.service.dadata, st, config.Cache{KeyPrefix: "dadataproxy", KeyVersion: 2, ScanMatch: "*", ScanCount: 10}, suite.service.logger)
+
+	segmentKey := "suggest:address:" + proxy.makeHash("/suggest/address", `{"query":"мск"}`)
+	suite.Require().NoError(st.Save(context.Background(), segmentKey, `{"suggestions":[]}`, 0))
+	suite.Require().NoError(proxy.RegisterMigration(Migration{
+		ID:    "drop-iplocate",
+		Match: "dadataproxy:v2:iplocate:*",
+		Transform: func(key string, value string) (string, string, error) {
+			return "", "", nil
+		},
+	}))
+	suite.ErrorIs(proxy.RegisterMigration(Migration{ID: "drop-iplocate", Match: "*", Transform: func(string, string) (string, string, error) { return "", "", nil }}), ErrDuplicateMigration)
+
+	migrated := func(results []MigrationResult, id string) int64 {
+		for _, result := range results {
+			if result.ID == id {
+				return result.Migrated
+			}
+		}
+		suite.Failf("migration not run", "migration %s", id)
+		return 0
+	}
+
+	results, err := proxy.RunMigrations(context.Background(), true, suite.service.logger)
+	suite.Require().NoError(err)
+	suite.Require().Len(results, 8)
+	suite.Equal(int64(1), migrated(results, "segment-keys-suggest"))
+	suite.Equal(int64(0), migrated(results, "segment-keys-clean"))
+
+	_, err = st.Read(context.Background(), segmentKey)
+	suite.Require().NoError(err, "dry run must not move keys")
+
+	results, err = proxy.RunMigrations(context.Background(), false, suite.service.logger)
+	suite.Require().NoError(err)
+	suite.Equal(int64(1), migrated(results, "segment-keys-suggest"))
+
+	_, err = st.Read(context.Background(), "dadataproxy:v2:"+segmentKey)
+	suite.Require().NoError(err)
+
+	results, err = proxy.RunMigrations(context.Background(), false, suite.service.logger)
+	suite.Require().NoError(err)
+	for _, result := range results {
+		suite.True(result.Skipped, result.ID)
+	}
+
+	migrations, err := proxy.Migrations(context.Background())
+	suite.Require().NoError(err)
+	suite.Equal("drop-iplocate", migrations[7].ID)
+	suite.NotNil(migrations[7].AppliedAt)
+}
+
+func (suite *ProxyServiceTestSuite) TestMigrateIntoNormalizedKeys() {
+	st := memory.New(100, time.Hour, suite.service.logger)
+	proxy := New(suite.service.dadata, st, config.Cache{
+		KeyPrefix:  "dadataproxy",
+		KeyVersion: normalizedKeyVersion,
+		ScanCount:  10,
+		Normalize:  map[string]config.Normalization{"/clean/address": {Whitespace: true, Case: true, Punctuation: true}},
+	}, suite.service.logger)
+
+	addressKey := "dadataproxy:v2:clean:address:" + proxy.makeHash("/clean/address", `["Мск, Сухонская 11"]`)
+	suggestKey := "dadataproxy:v2:suggest:address:" + proxy.makeHash("/suggest/address", `{"query":"Мск"}`)
+	suite.Require().NoError(st.Save(context.Background(), addressKey, `[{"source":"Мск, Сухонская 11"}]`, 0))
+	suite.Require().NoError(st.Save(context.Background(), addressKey+staleSuffix, `[{"source":"Мск, Сухонская 11"}]`, 0))
+	suite.Require().NoError(st.Save(context.Background(), suggestKey, `{"suggestions":[]}`, 0))
+
+	migrated, err := proxy.MigrateCache(context.Background(), 2, suite.service.logger)
+	suite.Require().NoError(err)
+	suite.Equal(int64(2), migrated)
+
+	newKey := proxy.makeKey("/clean/address", `["мск сухонская 11"]`)
+	for _, key := range []string{newKey, newKey + staleSuffix} {
+		value, err := st.Read(context.Background(), key)
+		suite.Require().NoError(err, key)
+		suite.Equal(`[{"source":"Мск, Сухонская 11"}]`, value)
+	}
+
+	_, err = st.Read(context.Background(), suggestKey)
+	suite.NoError(err, "a key that cannot be re-keyed stays until it expires")
+	_, err = st.Read(context.Background(), "dadataproxy:v3:suggest:address:"+proxy.makeHash("/suggest/address", `{"query":"Мск"}`))
+	suite.ErrorIs(err, storage.ErrKeyNotFound)
+}
+
+func (suite *ProxyServiceTestSuite) TestRunMigrationsLeaseAndFailures() {
+	st := memory.New(100, time.Hour, suite.service.logger)
+	proxy := New(suite.service.dadata, st, config.Cache{KeyPrefix: "dadataproxy", KeyVersion: 1, ScanMatch: "*", ScanCount: 10}, suite.service.logger)
+
+	suite.Require().NoError(st.Save(context.Background(), "custom:broken", "value", 0))
+	suite.Require().NoError(proxy.RegisterMigration(Migration{
+		ID:    "custom",
+		Match: "custom:*",
+		Transform: func(key string, value string) (string, string, error) {
+			return "", "", errors.New("cannot transform")
+		},
+	}))
+
+	suite.Require().NoError(st.Save(context.Background(), proxy.migrationKey("legacy-hash-keys")+migrationLeaseSuffix, "other", time.Minute))
+
+	_, err := proxy.RunMigrations(context.Background(), false, suite.service.logger)
+	suite.ErrorIs(err, ErrMigrationLocked)
+
+	_, err = st.Delete(context.Background(), proxy.migrationKey("legacy-hash-keys")+migrationLeaseSuffix)
+	suite.Require().NoError(err)
+
+	results, err := proxy.RunMigrations(context.Background(), false, suite.service.logger)
+	suite.Require().NoError(err)
+	suite.Equal(MigrationResult{ID: "custom", Matched: 1, Failed: 1}, results[len(results)-1])
+
+	migrations, err := proxy.Migrations(context.Background())
+	suite.Require().NoError(err)
+	suite.NotNil(migrations[0].AppliedAt)
+	suite.Nil(migrations[len(migrations)-1].AppliedAt, "a migration with failed keys is retried")
+
+	var leases []string
+	suite.Require().NoError(st.ScanKeys(context.Background(), "*"+migrationLeaseSuffix, 0, func(keys []string) error {
+		leases = append(leases, keys...)
+		return nil
+	}))
+	suite.Empty(leases)
+}
+
+func (suite *ProxyServiceTestSuite) TestStartMigrationsJobOnce() {
+	st := memory.New(100, time.Hour, suite.service.logger)
+	proxy := New(suite.service.dadata, st, config.Cache{KeyPrefix: "dadataproxy", KeyVersion: 2}, suite.service.logger)
+
+	suite.Require().NoError(proxy.createJob(context.Background(), &Job{
+		ID:         "running",
+		Kind:       JobKindMigrations,
+		Status:     JobRunning,
+		Params:     json.RawMessage(`{"dry_run":false}`),
+		Owner:      "other",
+		LeaseUntil: time.Now().Add(time.Minute),
+	}))
+
+	_, err := proxy.StartMigrationsJob(context.Background(), false, suite.service.logger)
+	suite.ErrorIs(err, ErrMigrationsRunning)
+
+	_, err = proxy.StartMigrationsJob(context.Background(), true, suite.service.logger)
+	suite.NoError(err)
+}
+
+func (suite *ProxyServiceTestSuite) TestFlightGroupCollapsesCalls() {
+	group := newFlightGroup()
+	release := make(chan struct{})
+	var calls atomic.Int32
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, _, err := group.do(context.Background(), "key", func(context.Context) (interface{}, error) {
+				calls.Add(1)
+				<-release
+				return "value", nil
+			})
+			suite.NoError(err)
+			suite.Equal("value", value)
+		}()
+	}
+
+	suite.Eventually(func() bool { return group.Collapsed() == 9 }, time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	suite.Equal(int32(1), calls.Load())
+}
+
+func (suite *ProxyServiceTestSuite) TestServeStaleOnError() {
+	const (
+		path  = "/clean/address"
+		query = `["мск сухонская 11"]`
+	)
+
+	st := memory.New(100, time.Hour, suite.service.logger)
+	cfg := config.Cache{
+		KeyPrefix:  "dadataproxy",
+		KeyVersion: 2,
+		Policies:   map[string]config.CachePolicy{"/clean/*": {TTL: time.Hour, Stale: true, StaleTTL: 24 * time.Hour}},
+	}
+
+	proxy := New(suite.newDaData(MockTransport{}), st, cfg, suite.service.logger)
+	proxy.saveResult(context.Background(), proxy.makeKey(path, query), []byte(`[{"source":"мск сухонская 11"}]`), cfg.Policies["/clean/*"])
+
+	failing := New(suite.newDaData(MockTransport{StatusCode: http.StatusServiceUnavailable}), st, cfg, suite.service.logger)
+
+	result, stale, err := failing.CleanValue(context.Background(), path, query, true, suite.service.logger)
+	suite.Require().NoError(err)
+	suite.True(stale)
+	suite.Equal("мск сухонская 11", (*result)[0]["source"])
+
+	_, _, err = failing.CleanValue(context.Background(), path, `["другой адрес"]`, true, suite.service.logger)
+	suite.ErrorIs(err, dadata.ErrUpstreamUnavailable)
+}
+
+func (suite *ProxyServiceTestSuite) TestServeCachedWhenRateLimited() {
+	const (
+		path  = "/clean/address"
+		query = `["мск сухонская 11"]`
+	)
+
+	client, err := dadata.New(config.DaData{
+		Token:     "ComeAndGetYourOwnSecretKey",
+		SecretKey: "ComeAndGetYourOwnSecretKey",
+		CleanUrl:  "https://cleaner.dadata.ru/api/v1",
+		RateLimit: config.RateLimit{Mode: config.RateLimitCache, Clean: config.RateBudget{PerDay: 1}},
+	}, MockTransport{}, suite.logger)
+	suite.Require().NoError(err)
+
+	st := memory.New(100, time.Hour, suite.service.logger)
+	cfg := config.Cache{
+		KeyPrefix:  "dadataproxy",
+		KeyVersion: 2,
+		Policies:   map[string]config.CachePolicy{"/clean/*": {TTL: time.Hour}},
+	}
+	proxy := New(client, st, cfg, suite.service.logger)
+
+	_, _, err = proxy.CleanValue(context.Background(), path, query, false, suite.service.logger)
+	suite.Require().NoError(err)
+	suite.Eventually(func() bool {
+		_, err := st.Read(context.Background(), proxy.makeKey(path, query))
+		return err == nil
+	}, time.Second, time.Millisecond)
+
+	result, stale, err := proxy.CleanValue(context.Background(), path, query, true, suite.service.logger)
+	suite.Require().NoError(err, "cache mode serves cached values without a stale policy")
+	suite.True(stale)
+	suite.Equal("мск сухонская 11", (*result)[0]["source"])
+
+	_, _, err = proxy.CleanValue(context.Background(), path, `["другой адрес"]`, true, suite.service.logger)
+	suite.ErrorIs(err, dadata.ErrRateLimited)
+}
+
+func (suite *ProxyServiceTestSuite) TestFlightGroupCancelsAbandonedCall() {
+	group := newFlightGroup()
+	cancelled := make(chan struct{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	_, _, err := group.do(ctx, "key", func(callCtx context.Context) (interface{}, error) {
+		<-callCtx.Done()
+		close(cancelled)
+		return nil, callCtx.Err()
+	})
+	suite.ErrorIs(err, context.Canceled)
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		suite.Fail("upstream call was not cancelled")
+	}
+}
+
+func (suite *ProxyServiceTestSuite) TestValidateCoordinates() {
+	suite.NoError(validateCoordinates(`{"lat":55.878,"lon":37.653}`))
+	suite.NoError(validateCoordinates(`{"lat":"55.878","lon":"37.653","radius_meters":100}`))
+
+	for _, query := range []string{
+		`{"lon":37.653}`,
+		`{"lat":95,"lon":37.653}`,
+		`{"lat":55.878,"lon":-181}`,
+		`{"lat":"north","lon":37.653}`,
+		`{"lat":"NaN","lon":37.653}`,
+		`{"lat":55.878,"lon":"-Inf"}`,
+		`{"lat":55.878,"lon":37.653,"radius_meters":5000}`,
+		`not json`,
+	} {
+		suite.ErrorIs(validateCoordinates(query), ErrInvalidCoordinates, query)
+	}
+}
+
+func (suite *ProxyServiceTestSuite) TestInvalidQuery() {
+	_, _, err := suite.service.CleanValue(context.Background(), "/clean/address", `["мск"`, false, suite.service.logger)
+	suite.ErrorIs(err, ErrInvalidQuery)
+
+	_, _, err = suite.service.SuggestValue(context.Background(), "/suggest/address", `query=мск`, false, suite.service.logger)
+	suite.ErrorIs(err, ErrInvalidQuery)
+
+	_, _, err = suite.service.CleanBatch(context.Background(), "/clean/address", `{"query":"мск"}`, false, suite.service.logger)
+	suite.ErrorIs(err, ErrInvalidQuery)
+
+	_, _, err = suite.service.CleanBatch(context.Background(), "/clean/address", `[]`, false, suite.service.logger)
+	suite.ErrorIs(err, ErrEmptyBatch)
+	suite.ErrorIs(err, ErrInvalidQuery)
+}
+
+func (suite *ProxyServiceTestSuite) TestCleanBatch() {
+	const path = "/clean/address"
+
+	st := memory.New(1000, time.Hour, suite.service.logger)
+	transport := &batchTransport{}
+	proxy := New(suite.newDaData(transport), st, config.Cache{KeyPrefix: "dadataproxy", KeyVersion: 2}, suite.service.logger)
+
+	suite.Require().NoError(st.Save(context.Background(), proxy.makeKey(path, `["cached"]`), `[{"source":"cached","result":"FROM CACHE"}]`, 0))
+
+	result, stale, err := proxy.CleanBatch(context.Background(), path, `["first", "cached", "second", "first"]`, false, suite.service.logger)
+	suite.Require().NoError(err)
+	suite.False(stale)
+	suite.Equal([]int{2}, transport.sizes)
+
+	results := make([]interface{}, 0, len(*result))
+	for _, item := range *result {
+		results = append(results, item["result"])
+	}
+	suite.Equal([]interface{}{"FIRST", "FROM CACHE", "SECOND", "FIRST"}, results)
+
+	usage := proxy.usage.snapshot(proxy.price)[otherEndpoints]
+	suite.Equal(uint64(2), usage.UpstreamCalls)
+	suite.Equal(uint64(1), usage.CacheHits)
+
+	suite.Eventually(func() bool {
+		value, err := st.Read(context.Background(), proxy.makeKey(path, `["second"]`))
+		return err == nil && value != nil
+	}, time.Second, time.Millisecond)
+
+	items := make([]string, 120)
+	for index := range items {
+		items[index] = fmt.Sprintf("address %d", index)
+	}
+	data, _ := json.Marshal(items)
+
+	transport.sizes = nil
+	result, _, err = proxy.CleanBatch(context.Background(), path, string(data), false, suite.service.logger)
+	suite.Require().NoError(err)
+	suite.Equal([]int{50, 50, 20}, transport.sizes)
+	suite.Equal("ADDRESS 119", (*result)[119]["result"])
+}
+
+func (suite *ProxyServiceTestSuite) TestCleanBatchPartialFailure() {
+	const path = "/clean/address"
+
+	st := memory.New(100, time.Hour, suite.service.logger)
+	cfg := config.Cache{
+		KeyPrefix:  "dadataproxy",
+		KeyVersion: 2,
+		Policies:   map[string]config.CachePolicy{"/clean/*": {TTL: time.Hour, Stale: true, StaleTTL: 24 * time.Hour}},
+	}
+	proxy := New(suite.newDaData(MockTransport{StatusCode: http.StatusServiceUnavailable}), st, cfg, suite.service.logger)
+	proxy.saveResult(context.Background(), proxy.makeKey(path, `["stale"]`), []byte(`[{"source":"stale","result":"STALE"}]`), cfg.Policies["/clean/*"])
+
+	result, stale, err := proxy.CleanBatch(context.Background(), path, `["missing", "stale", "missing"]`, true, suite.service.logger)
+
+	var batchErr *BatchError
+	suite.Require().ErrorAs(err, &batchErr)
+	suite.ErrorIs(err, dadata.ErrUpstreamUnavailable)
+	suite.Equal([]int{0, 2}, batchErr.Positions)
+	suite.True(stale)
+	suite.Require().NotNil(result)
+	suite.Nil((*result)[0])
+	suite.Equal("STALE", (*result)[1]["result"])
+}
+
+func (suite *ProxyServiceTestSuite) TestFileJob() {
+	st := memory.New(1000, time.Hour, suite.service.logger)
+	proxy := New(suite.newDaData(MockTransport{}), st, config.Cache{KeyPrefix: "dadataproxy", KeyVersion: 2}, suite.service.logger)
+
+	file := []byte("id,address\n1,мск сухонская 11\n2,\n3,спб невский 1\n")
+
+	_, err := proxy.StartFileJob(context.Background(), file, "address", "street", suite.service.logger)
+	suite.ErrorIs(err, ErrColumnNotFound)
+
+	job, err := proxy.StartFileJob(context.Background(), file, "address", "address", suite.service.logger)
+	suite.Require().NoError(err)
+	suite.Equal(JobKindCleanFile, job.Kind)
+
+	suite.Eventually(func() bool {
+		job, err := proxy.Job(context.Background(), job.ID)
+		return err == nil && job.Status == JobDone
+	}, time.Second, time.Millisecond)
+
+	result, err := proxy.FileJobResult(context.Background(), job.ID)
+	suite.Require().NoError(err)
+	suite.Equal("id,address,address_result\n1,мск сухонская 11,МСК СУХОНСКАЯ 11\n2,,\n3,спб невский 1,СПБ НЕВСКИЙ 1\n", string(result))
+}
+
+// failingTransport answers 503 to the requests whose body contains
+// marker and echoes the others like MockTransport.
+type failingTransport struct {
+	marker string
+}
+
+func (t failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	if strings.Contains(string(body), t.marker) {
+		return MockTransport{StatusCode: http.StatusServiceUnavailable}.RoundTrip(req)
+	}
+
+	return MockTransport{}.RoundTrip(req)
+}
+
+func (suite *ProxyServiceTestSuite) TestFileJobFailedRows() {
+	st := memory.New(1000, time.Hour, suite.service.logger)
+	proxy := New(suite.newDaData(failingTransport{marker: "bad"}), st, config.Cache{KeyPrefix: "dadataproxy", KeyVersion: 2}, suite.service.logger)
+
+	file := "id,address\n"
+	for row := 0; row < 120; row++ {
+		address := fmt.Sprintf("address %d", row)
+		if row == 60 {
+			address = "bad address"
+		}
+		file += fmt.Sprintf("%d,%s\n", row, address)
+	}
+
+	job, err := proxy.StartFileJob(context.Background(), []byte(file), "address", "address", suite.service.logger)
+	suite.Require().NoError(err)
+
+	suite.Eventually(func() bool {
+		job, err = proxy.Job(context.Background(), job.ID)
+		return err == nil && job.Status == JobDone
+	}, time.Second, time.Millisecond)
+
+	suite.Equal(int64(120), job.Processed)
+	suite.Equal(int64(batchSize), job.Failed, "the rows of the failed upstream request")
+
+	jobErrors, err := proxy.JobErrors(context.Background(), job.ID)
+	suite.Require().NoError(err)
+	suite.Require().Len(jobErrors, batchSize)
+	suite.Equal("row 51", jobErrors[0].Key)
+
+	result, err := proxy.FileJobResult(context.Background(), job.ID)
+	suite.Require().NoError(err)
+	suite.Contains(string(result), "119,address 119,ADDRESS 119\n")
+	suite.Contains(string(result), "60,bad address,\n")
+}
+
+func (suite *ProxyServiceTestSuite) TestFileJobResumesFromCheckpoint() {
+	const id = "resumed"
+
+	st := memory.New(1000, time.Hour, suite.service.logger)
+	transport := &batchTransport{}
+	proxy := New(suite.newDaData(transport), st, config.Cache{KeyPrefix: "dadataproxy", KeyVersion: 2}, suite.service.logger)
+
+	file := "id,address\n"
+	done := make([]map[string]interface{}, jobChunkSize)
+	for row := 0; row < jobChunkSize+10; row++ {
+		file += fmt.Sprintf("%d,address %d\n", row, row)
+		if row < jobChunkSize {
+			done[row] = map[string]interface{}{"result": "FROM CHECKPOINT"}
+		}
+	}
+
+	suite.Require().NoError(st.Save(context.Background(), proxy.jobKey(id)+jobInputSuffix, file, 0))
+	suite.Require().NoError(proxy.saveFileJobChunk(context.Background(), proxy.jobKey(id)+jobChunkSuffix+"0", done))
+	suite.Require().NoError(proxy.saveFileJobCheckpoint(context.Background(), id, fileJobCheckpoint{Offset: jobChunkSize}))
+
+	result, chunks, err := proxy.cleanFile(context.Background(), id, fileJobParams{Type: "address", Column: "address"}, discardProgress{}, suite.service.logger)
+	suite.Require().NoError(err)
+	suite.Len(chunks, 2)
+	suite.Equal([]int{10}, transport.sizes)
+	suite.Contains(string(result), "0,address 0,FROM CHECKPOINT\n")
+	suite.Contains(string(result), "509,address 509,ADDRESS 509\n")
+}
+
+func (suite *ProxyServiceTestSuite) TestMigrateJob() {
+	st := memory.New(100, time.Hour, suite.service.logger)
+	proxy := New(suite.service.dadata, st, config.Cache{KeyPrefix: "dadataproxy", KeyVersion: 2, ScanMatch: "*", ScanCount: 10}, suite.service.logger)
+
+	suite.Require().NoError(st.Save(context.Background(), "dadataproxy:v1:suggest:address:abc", `{"suggestions":[]}`, 0))
+	suite.Require().NoError(st.Save(context.Background(), "dadataproxy:v1:abc", `{}`, 0))
+
+	_, err := proxy.StartMigrateJob(context.Background(), 2, suite.service.logger)
+	suite.ErrorIs(err, ErrInvalidVersion)
+
+	job, err := proxy.StartMigrateJob(context.Background(), 1, suite.service.logger)
+	suite.Require().NoError(err)
+
+	suite.Eventually(func() bool {
+		job, err = proxy.Job(context.Background(), job.ID)
+		return err == nil && job.Status == JobDone
+	}, time.Second, time.Millisecond)
+
+	suite.JSONEq(`{"migrated":1}`, string(job.Result))
+	suite.Equal(int64(1), job.Failed)
+
+	jobErrors, err := proxy.JobErrors(context.Background(), job.ID)
+	suite.Require().NoError(err)
+	suite.Require().Len(jobErrors, 1)
+	suite.Equal("dadataproxy:v1:abc", jobErrors[0].Key)
+}
+
+// blockingTransport holds every request until it is cancelled.
+type blockingTransport struct{}
+
+func (blockingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	<-req.Context().Done()
+	return nil, req.Context().Err()
+}
+
+func (suite *ProxyServiceTestSuite) TestCancelJob() {
+	st := memory.New(100, time.Hour, suite.service.logger)
+	proxy := New(suite.newDaData(blockingTransport{}), st, config.Cache{KeyPrefix: "dadataproxy", KeyVersion: 2}, suite.service.logger)
+
+	job, err := proxy.StartWarmJob(context.Background(), "/suggest/address", []json.RawMessage{json.RawMessage(`{"query":"мск"}`)}, suite.service.logger)
+	suite.Require().NoError(err)
+
+	suite.Eventually(func() bool {
+		job, err := proxy.Job(context.Background(), job.ID)
+		return err == nil && job.Status == JobRunning
+	}, time.Second, time.Millisecond)
+
+	_, err = proxy.CancelJob(context.Background(), job.ID, suite.service.logger)
+	suite.Require().NoError(err)
+
+	suite.Eventually(func() bool {
+		proxy.jobs.mu.Lock()
+		defer proxy.jobs.mu.Unlock()
+		return len(proxy.jobs.cancels) == 0
+	}, time.Second, time.Millisecond)
+
+	job, err = proxy.Job(context.Background(), job.ID)
+	suite.Require().NoError(err)
+	suite.Equal(JobCancelled, job.Status)
+
+	_, err = proxy.CancelJob(context.Background(), job.ID, suite.service.logger)
+	suite.ErrorIs(err, ErrJobFinished)
+}
+
+func (suite *ProxyServiceTestSuite) TestResumeJobsRespectsLease() {
+	st := memory.New(100, time.Hour, suite.service.logger)
+	proxy := New(suite.newDaData(MockTransport{}), st, config.Cache{KeyPrefix: "dadataproxy", KeyVersion: 2}, suite.service.logger)
+
+	params := json.RawMessage(`{"path":"/clean/address","queries":[["мск"]]}`)
+	for _, job := range []*Job{
+		{ID: "leased", Kind: JobKindWarm, Status: JobRunning, Params: params, Owner: "other", LeaseUntil: time.Now().Add(time.Minute)},
+		{ID: "expired", Kind: JobKindWarm, Status: JobRunning, Params: params, Owner: "other", LeaseUntil: time.Now().Add(-time.Second)},
+	} {
+		suite.Require().NoError(proxy.createJob(context.Background(), job))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	suite.Require().NoError(proxy.ResumeJobs(ctx, suite.service.logger))
+
+	var job *Job
+	suite.Eventually(func() bool {
+		var err error
+		job, err = proxy.Job(context.Background(), "expired")
+		return err == nil && job.Status == JobDone
+	}, time.Second, time.Millisecond)
+	suite.Equal(proxy.jobs.owner, job.Owner)
+
+	job, err := proxy.Job(context.Background(), "leased")
+	suite.Require().NoError(err)
+	suite.Equal(JobRunning, job.Status)
+	suite.Equal("other", job.Owner)
+
+	_, err = proxy.claimJob(context.Background(), "leased")
+	suite.ErrorIs(err, errJobOwned)
+}
+
+func (suite *ProxyServiceTestSuite) TestLocalJobIsNotRunTwice() {
+	st := memory.New(100, time.Hour, suite.service.logger)
+	proxy := New(suite.newDaData(MockTransport{}), st, config.Cache{KeyPrefix: "dadataproxy", KeyVersion: 2}, suite.service.logger)
+
+	params := json.RawMessage(`{"path":"/clean/address","queries":[["мск"]]}`)
+	lapsed := &Job{ID: "local", Kind: JobKindWarm, Status: JobRunning, Params: params, Owner: proxy.jobs.owner, LeaseUntil: time.Now().Add(-time.Second)}
+	suite.Require().NoError(proxy.createJob(context.Background(), lapsed))
+
+	_, stop := context.WithCancelCause(context.Background())
+	defer stop(nil)
+	suite.Require().True(proxy.jobs.start("local", stop))
+
+	suite.Require().NoError(proxy.resumeJobs(context.Background(), suite.service.logger))
+	proxy.runJob(context.Background(), lapsed, suite.service.logger)
+
+	job, err := proxy.Job(context.Background(), "local")
+	suite.Require().NoError(err)
+	suite.Equal(JobRunning, job.Status)
+	suite.True(job.LeaseUntil.Before(time.Now()))
+
+	proxy.jobs.stop("local")
+	proxy.runJob(context.Background(), lapsed, suite.service.logger)
+
+	job, err = proxy.Job(context.Background(), "local")
+	suite.Require().NoError(err)
+	suite.Equal(JobDone, job.Status)
+}
+
+func (suite *ProxyServiceTestSuite) TestCancelledJobIsNotOverwritten() {
+	st := memory.New(100, time.Hour, suite.service.logger)
+	proxy := New(suite.newDaData(MockTransport{}), st, config.Cache{KeyPrefix: "dadataproxy", KeyVersion: 2}, suite.service.logger)
+
+	suite.Require().NoError(proxy.createJob(context.Background(), &Job{ID: "job", Kind: JobKindWarm, Status: JobPending}))
+
+	job, err := proxy.claimJob(context.Background(), "job")
+	suite.Require().NoError(err)
+
+	_, err = proxy.CancelJob(context.Background(), "job", suite.service.logger)
+	suite.Require().NoError(err)
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	progress := &jobProgress{service: *proxy, job: job, cancel: cancel, logger: suite.service.logger}
+	progress.advance(ctx, 10)
+	suite.Require().NoError(progress.flush(ctx))
+	suite.ErrorIs(context.Cause(ctx), errJobCancelled)
+
+	proxy.finishJob(context.Background(), job, nil, nil, suite.service.logger)
+
+	job, err = proxy.Job(context.Background(), "job")
+	suite.Require().NoError(err)
+	suite.Equal(JobCancelled, job.Status)
+	suite.Zero(job.Processed)
+}
+
+func (suite *ProxyServiceTestSuite) TestNormalizeQuery() {
+	suite.service.config.Normalize = map[string]config.Normalization{
+		"/clean/address": {Whitespace: true, Case: true, Punctuation: true, Yo: true},
+		"/clean/*":       {Whitespace: true, Case: true, Yo: true},
+		"/suggest/*":     {Whitespace: true, Case: true, Defaults: map[string]string{"count": "10"}, Drop: []string{"debug"}},
+	}
+
+	for _, data := range []string{`["Мск, Сухонская 11"]`, `[" мск  сухонская 11 "]`, `["МСК; СУХОНСКАЯ 11."]`} {
+		query, err := suite.service.normalizeQuery("/clean/address", data)
+		suite.Require().NoError(err)
+		suite.Equal(`["мск сухонская 11"]`, query, data)
+	}
+
+	query, err := suite.service.normalizeQuery("/clean/address", `["Щёлково"]`)
+	suite.Require().NoError(err)
+	suite.Equal(`["щелково"]`, query)
+
+	query, err = suite.service.normalizeQuery("/clean/email", `[" Ivan.Petrov@Mail.ru "]`)
+	suite.Require().NoError(err)
+	suite.Equal(`["ivan.petrov@mail.ru"]`, query, "punctuation is folded for addresses only")
+
+	query, err = suite.service.normalizeQuery("/clean/address", `[{"name":"а.б."}]`)
+	suite.Require().NoError(err)
+	suite.Equal(`[{"name":"а.б."}]`, query, "query texts only are normalised")
+
+	query, err = suite.service.normalizeQuery("/suggest/address", `{"query":"Мск  Сухонская","count":10,"debug":true,"locations":[{"region":" Москва "}]}`)
+	suite.Require().NoError(err)
+	suite.Equal(`{"locations":[{"region":" Москва "}],"query":"мск сухонская"}`, query)
+
+	query, err = suite.service.normalizeQuery("/suggest/party", `{"query":"Сбер","type":"LEGAL","status":["ACTIVE"]}`)
+	suite.Require().NoError(err)
+	suite.Equal(`{"query":"сбер","status":["ACTIVE"],"type":"LEGAL"}`, query, "filters are kept as they are")
+
+	query, err = suite.service.normalizeQuery("/iplocate/address", `{ "ip" : "46.226.227.20" }`)
+	suite.Require().NoError(err)
+	suite.Equal(`{"ip":"46.226.227.20"}`, query)
+}
+
+func (suite *ProxyServiceTestSuite) TestNormalizedQueriesShareCache() {
+	const path = "/clean/address"
+
+	st := memory.New(100, time.Hour, suite.service.logger)
+	transport := &batchTransport{}
+	proxy := New(suite.newDaData(transport), st, config.Cache{
+		KeyPrefix:  "dadataproxy",
+		KeyVersion: 2,
+		Normalize:  map[string]config.Normalization{"/clean/*": {Whitespace: true, Case: true, Punctuation: true, Yo: true}},
+	}, suite.service.logger)
+
+	first := `[ "Мск, Сухонская  11" ]`
+	_, _, err := proxy.CleanValue(context.Background(), path, first, false, suite.service.logger)
+	suite.Require().NoError(err)
+	suite.Equal([]string{first}, transport.bodies, "upstream gets the query as sent")
+
+	suite.Eventually(func() bool {
+		value, err := st.Read(context.Background(), proxy.makeKey(path, `["мск сухонская 11"]`))
+		return err == nil && value != nil
+	}, time.Second, time.Millisecond)
+
+	result, _, err := proxy.CleanValue(context.Background(), path, `["мск сухонская 11"]`, false, suite.service.logger)
+	suite.Require().NoError(err)
+	suite.Len(transport.bodies, 1)
+	suite.Equal("мск сухонская 11", (*result)[0]["source"], "the source is the one of the request")
+	suite.Equal("МСК, СУХОНСКАЯ  11", (*result)[0]["result"], "the result is the cached one")
+
+	result, _, err = proxy.CleanBatch(context.Background(), path, `["МСК; Сухонская 11", "мск сухонская 11"]`, false, suite.service.logger)
+	suite.Require().NoError(err)
+	suite.Len(transport.bodies, 1)
+	suite.Equal("МСК; Сухонская 11", (*result)[0]["source"])
+	suite.Equal("мск сухонская 11", (*result)[1]["source"])
+}
+
+func (suite *ProxyServiceTestSuite) TestUsage() {
+	suite.service.config.Pricing = map[string]float64{
+		"/clean/*":       0.1,
+		"/clean/address": 0.15,
+	}
+
+	routed := WithEndpoint(context.Background(), "/suggest/*")
+	job := WithEndpoint(context.Background(), jobEndpoint+JobKindWarm)
+
+	suite.Equal("/clean/address", suite.service.usageEndpoint(context.Background(), "clean/address"))
+	suite.Equal("/clean/*", suite.service.usageEndpoint(context.Background(), "/clean/phone"))
+	suite.Equal("/suggest/*", suite.service.usageEndpoint(routed, "/suggest/address?x=1"))
+	suite.Equal("job:warm", suite.service.usageEndpoint(job, "/suggest/address"))
+	suite.Equal("/clean/*", suite.service.usageEndpoint(job, "/clean/name"))
+	suite.Equal(otherEndpoints, suite.service.usageEndpoint(context.Background(), "/suggest/anything"))
+
+	suite.service.usage.call("/clean/address")
+	suite.service.usage.hit("/clean/address")
+	suite.service.usage.hit("/clean/address")
+	suite.service.usage.hit("/clean/*")
+	suite.service.usage.hit("/suggest/*")
+
+	usage := suite.service.usage.snapshot(suite.service.price)
+	suite.Equal(uint64(1), usage["/clean/address"].UpstreamCalls)
+	suite.Equal(uint64(2), usage["/clean/address"].CacheHits)
+	suite.InDelta(0.3, usage["/clean/address"].Saved, 1e-9)
+	suite.InDelta(0.1, usage["/clean/*"].Saved, 1e-9)
+	suite.Zero(usage["/suggest/*"].Saved)
+}
+
+// countingTransport answers every request with an empty JSON object and
+// counts the requests.
+type countingTransport struct {
+	calls atomic.Int32
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.calls.Add(1)
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader(`{}`)),
+		Request:    req,
+	}, nil
+}
+
+func (suite *ProxyServiceTestSuite) TestPassthroughKey() {
+	transport := &countingTransport{}
+	st := memory.New(100, time.Hour, suite.service.logger)
+	proxy := New(suite.newDaData(transport), st, config.Cache{KeyPrefix: "dadataproxy", KeyVersion: 2}, suite.service.logger)
+	route := config.PassthroughRoute{Path: "/suggest/fias", Host: dadata.HostSuggest, Cache: true}
+
+	request := func(method string, rawQuery string) {
+		_, _, err := proxy.PassthroughValue(context.Background(), route, method, route.Path, rawQuery, "", "", false, suite.service.logger)
+		suite.Require().NoError(err)
+	}
+	cached := func(method string, rawQuery string) bool {
+		_, err := st.Read(context.Background(), proxy.makeKey(route.Path, method+"\n"+rawQuery+"\n{}"))
+		return err == nil
+	}
+
+	request(http.MethodGet, "query=a")
+	suite.Eventually(func() bool { return cached(http.MethodGet, "query=a") }, time.Second, time.Millisecond)
+
+	request(http.MethodGet, "query=a")
+	request(http.MethodGet, "query=b")
+	request(http.MethodPost, "query=a")
+	suite.Equal(int32(3), transport.calls.Load())
+}
+
 func TestServiceTestSuite(t *testing.T) {
 	t.Parallel()
 	suite.Run(t, new(ProxyServiceTestSuite))
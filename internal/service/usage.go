@@ -0,0 +1,95 @@
+package service
+
+import (
+	"context"
+	"sync"
+)
+
+// otherEndpoints counts the requests matching neither a pricing pattern
+// nor an endpoint set with WithEndpoint.
+const otherEndpoints = "other"
+
+type endpointKey struct{}
+
+// WithEndpoint returns a copy of ctx naming the endpoint the usage of
+// requests made with it is counted under when no pricing pattern matches,
+// e.g. the route pattern that served the request.
+func WithEndpoint(ctx context.Context, endpoint string) context.Context {
+	return context.WithValue(ctx, endpointKey{}, endpoint)
+}
+
+// EndpointUsage holds the proxy's own counters of one endpoint. Saved is
+// the estimated upstream spend avoided by cache hits.
+type EndpointUsage struct {
+	UpstreamCalls uint64  `json:"upstream_calls"`
+	CacheHits     uint64  `json:"cache_hits"`
+	Saved         float64 `json:"saved"`
+}
+
+type usageCounter struct {
+	mu        sync.Mutex
+	endpoints map[string]*EndpointUsage
+}
+
+func newUsageCounter() *usageCounter {
+	return &usageCounter{endpoints: make(map[string]*EndpointUsage)}
+}
+
+func (u *usageCounter) call(endpoint string) {
+	u.calls(endpoint, 1)
+}
+
+// calls counts a request carrying several items as that many calls.
+func (u *usageCounter) calls(endpoint string, items int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.endpoint(endpoint).UpstreamCalls += uint64(items)
+}
+
+func (u *usageCounter) hit(endpoint string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.endpoint(endpoint).CacheHits++
+}
+
+func (u *usageCounter) endpoint(endpoint string) *EndpointUsage {
+	usage, ok := u.endpoints[endpoint]
+	if !ok {
+		usage = &EndpointUsage{}
+		u.endpoints[endpoint] = usage
+	}
+
+	return usage
+}
+
+// usageEndpoint returns the counter name of a request to path: the
+// pricing pattern matching it, or the endpoint set on ctx, so the number
+// of counters is bounded by the configuration.
+func (s ProxyService) usageEndpoint(ctx context.Context, path string) string {
+	if pattern, ok := matchPattern(s.config.Pricing, path); ok {
+		return pattern
+	}
+
+	if endpoint, ok := ctx.Value(endpointKey{}).(string); ok && endpoint != "" {
+		return endpoint
+	}
+
+	return otherEndpoints
+}
+
+// snapshot returns a copy of the counters with Saved estimated by price.
+func (u *usageCounter) snapshot(price func(path string) float64) map[string]EndpointUsage {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	result := make(map[string]EndpointUsage, len(u.endpoints))
+	for path, usage := range u.endpoints {
+		snapshot := *usage
+		snapshot.Saved = float64(snapshot.CacheHits) * price(path)
+		result[path] = snapshot
+	}
+
+	return result
+}
@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type MatchTestSuite struct {
+	suite.Suite
+}
+
+func (suite *MatchTestSuite) TestMatch() {
+	tests := []struct {
+		pattern string
+		key     string
+		matched bool
+	}{
+		{"*", "", true},
+		{"*", "clean:address:abc", true},
+		{"clean:*", "clean:address:abc", true},
+		{"clean:*", "suggest:address:abc", false},
+		{"*:abc", "clean:address:abc", true},
+		{"a**c", "abbbc", true},
+		{"a*c", "abbbd", false},
+		{"?", "a", true},
+		{"?", "", false},
+		{"a?c", "abc", true},
+		{"a?c", "ac", false},
+		{"[abc]", "b", true},
+		{"[abc]", "d", false},
+		{"[a-z]", "m", true},
+		{"[a-z]", "M", false},
+		{"[z-a]", "m", true},
+		{"[a-]", "-", true},
+		{"[^x]", "y", true},
+		{"[^x]", "x", false},
+		{"[^a-c]", "b", false},
+		{"[^a-c]", "d", true},
+		{"[a-z]*", "", false},
+		{`\*`, "*", true},
+		{`\*`, "a", false},
+		{`a\?c`, "a?c", true},
+		{`a\?c`, "abc", false},
+		{`\[a]`, "[a]", true},
+		{`[\]]`, "]", true},
+		{`[\^]`, "^", true},
+		{`a\`, `a\`, true},
+		{"[abc", "a", false},
+		{"[^abc", "d", false},
+		{"x[a-", "xa", false},
+		{"abc", "abc", true},
+		{"abc", "abcd", false},
+		{"abcd", "abc", false},
+	}
+
+	for _, test := range tests {
+		suite.Equal(test.matched, Match(test.pattern, test.key), "pattern %q, key %q", test.pattern, test.key)
+	}
+}
+
+func (suite *MatchTestSuite) TestEscapePattern() {
+	for _, key := range []string{"clean:address", "clean:*", `a?b[c]\d`} {
+		suite.True(Match(EscapePattern(key), key), "key %q", key)
+	}
+
+	suite.False(Match(EscapePattern("clean:*"), "clean:address"))
+	suite.Equal(`clean:\*:\?`, EscapePattern("clean:*:?"))
+}
+
+func TestMatchTestSuite(t *testing.T) {
+	t.Parallel()
+	suite.Run(t, new(MatchTestSuite))
+}
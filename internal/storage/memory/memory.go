@@ -0,0 +1,246 @@
+package memory
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/ilazutin/dadataproxy_go/internal/storage"
+)
+
+type entry struct {
+	key       string
+	value     string
+	expiresAt time.Time
+}
+
+type Storage struct {
+	mu         sync.Mutex
+	items      map[string]*list.Element
+	order      *list.List
+	size       int
+	expiration time.Duration
+	logger     *slog.Logger
+}
+
+func New(size int, expiration time.Duration, logger *slog.Logger) *Storage {
+	return &Storage{
+		items:      make(map[string]*list.Element, size),
+		order:      list.New(),
+		size:       size,
+		expiration: expiration,
+		logger:     logger,
+	}
+}
+
+func (s *Storage) Save(ctx context.Context, key string, value interface{}, expiration time.Duration) error {
+	stringValue, err := toString(value)
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("memory storage error: %s", err))
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.set(key, stringValue, expiration)
+
+	return nil
+}
+
+func (s *Storage) SaveIfAbsent(ctx context.Context, key string, value interface{}, expiration time.Duration) (bool, error) {
+	stringValue, err := toString(value)
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("memory storage error: %s", err))
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.current(key); ok {
+		return false, nil
+	}
+
+	s.set(key, stringValue, expiration)
+
+	return true, nil
+}
+
+func (s *Storage) CompareAndSwap(ctx context.Context, key string, old string, value interface{}, expiration time.Duration) (bool, error) {
+	stringValue, err := toString(value)
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("memory storage error: %s", err))
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if current, ok := s.current(key); !ok || current != old {
+		return false, nil
+	}
+
+	s.set(key, stringValue, expiration)
+
+	return true, nil
+}
+
+func (s *Storage) Read(ctx context.Context, key string) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, ok := s.current(key)
+	if !ok {
+		return nil, storage.ErrKeyNotFound
+	}
+
+	s.order.MoveToFront(s.items[key])
+
+	return value, nil
+}
+
+func (s *Storage) TTL(ctx context.Context, key string) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.current(key); !ok {
+		return 0, storage.ErrKeyNotFound
+	}
+
+	expiresAt := s.items[key].Value.(*entry).expiresAt
+	if expiresAt.IsZero() {
+		return 0, nil
+	}
+
+	return time.Until(expiresAt), nil
+}
+
+func (s *Storage) ScanKeys(ctx context.Context, match string, count int64, fn func([]string) error) error {
+	keys := s.matchingKeys(match)
+	if count <= 0 {
+		count = int64(len(keys))
+	}
+
+	for start := int64(0); start < int64(len(keys)); start += count {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		end := min(start+count, int64(len(keys)))
+		if err := fn(keys[start:end]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Storage) Delete(ctx context.Context, keys ...string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var deleted int64
+	for _, key := range keys {
+		element, ok := s.items[key]
+		if !ok {
+			continue
+		}
+		if !element.Value.(*entry).expired(now) {
+			deleted++
+		}
+		s.removeElement(element)
+	}
+
+	return deleted, nil
+}
+
+func (s *Storage) matchingKeys(match string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	keys := make([]string, 0, len(s.items))
+	for key, element := range s.items {
+		if element.Value.(*entry).expired(now) || !storage.Match(match, key) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+// current returns the value of an unexpired key. It is called with the
+// lock held.
+func (s *Storage) current(key string) (string, bool) {
+	element, ok := s.items[key]
+	if !ok {
+		return "", false
+	}
+
+	item := element.Value.(*entry)
+	if item.expired(time.Now()) {
+		s.removeElement(element)
+		return "", false
+	}
+
+	return item.value, true
+}
+
+// set saves the value and evicts the least recently used keys over the
+// size. It is called with the lock held.
+func (s *Storage) set(key string, value string, expiration time.Duration) {
+	if expiration <= 0 {
+		expiration = s.expiration
+	}
+
+	var expiresAt time.Time
+	if expiration > 0 {
+		expiresAt = time.Now().Add(expiration)
+	}
+
+	if element, ok := s.items[key]; ok {
+		item := element.Value.(*entry)
+		item.value = value
+		item.expiresAt = expiresAt
+		s.order.MoveToFront(element)
+		return
+	}
+
+	s.items[key] = s.order.PushFront(&entry{
+		key:       key,
+		value:     value,
+		expiresAt: expiresAt,
+	})
+
+	for s.size > 0 && s.order.Len() > s.size {
+		s.removeElement(s.order.Back())
+	}
+}
+
+func (s *Storage) removeElement(element *list.Element) {
+	s.order.Remove(element)
+	delete(s.items, element.Value.(*entry).key)
+}
+
+func (e *entry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && now.After(e.expiresAt)
+}
+
+func toString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	case fmt.Stringer:
+		return v.String(), nil
+	default:
+		return "", fmt.Errorf("unsupported value type %T", value)
+	}
+}
@@ -0,0 +1,168 @@
+package memory
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/ilazutin/dadataproxy_go/internal/storage"
+)
+
+type MemoryStorageTestSuite struct {
+	suite.Suite
+
+	logger *slog.Logger
+}
+
+func (suite *MemoryStorageTestSuite) SetupTest() {
+	suite.logger = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+}
+
+func (suite *MemoryStorageTestSuite) TestSaveAndRead() {
+	st := New(10, time.Minute, suite.logger)
+
+	suite.Require().NoError(st.Save(context.Background(), "key", []byte(`{"a":1}`), 0))
+
+	value, err := st.Read(context.Background(), "key")
+	suite.Require().NoError(err)
+	suite.Equal(`{"a":1}`, value)
+}
+
+func (suite *MemoryStorageTestSuite) TestReadMissing() {
+	st := New(10, time.Minute, suite.logger)
+
+	value, err := st.Read(context.Background(), "missing")
+	suite.ErrorIs(err, storage.ErrKeyNotFound)
+	suite.Nil(value)
+}
+
+func (suite *MemoryStorageTestSuite) TestEvictsLeastRecentlyUsed() {
+	st := New(2, time.Minute, suite.logger)
+
+	suite.Require().NoError(st.Save(context.Background(), "first", "1", 0))
+	suite.Require().NoError(st.Save(context.Background(), "second", "2", 0))
+
+	_, err := st.Read(context.Background(), "first")
+	suite.Require().NoError(err)
+
+	suite.Require().NoError(st.Save(context.Background(), "third", "3", 0))
+
+	_, err = st.Read(context.Background(), "second")
+	suite.ErrorIs(err, storage.ErrKeyNotFound)
+
+	suite.ElementsMatch([]string{"first", "third"}, suite.scanAll(st, "*"))
+}
+
+func (suite *MemoryStorageTestSuite) TestExpiration() {
+	st := New(10, 10*time.Millisecond, suite.logger)
+
+	suite.Require().NoError(st.Save(context.Background(), "key", "value", 0))
+	time.Sleep(20 * time.Millisecond)
+
+	_, err := st.Read(context.Background(), "key")
+	suite.ErrorIs(err, storage.ErrKeyNotFound)
+
+	suite.Empty(suite.scanAll(st, "*"))
+}
+
+func (suite *MemoryStorageTestSuite) TestTTL() {
+	st := New(10, 0, suite.logger)
+
+	suite.Require().NoError(st.Save(context.Background(), "short", "value", time.Minute))
+	suite.Require().NoError(st.Save(context.Background(), "forever", "value", 0))
+
+	ttl, err := st.TTL(context.Background(), "short")
+	suite.Require().NoError(err)
+	suite.InDelta(time.Minute, ttl, float64(time.Second))
+
+	ttl, err = st.TTL(context.Background(), "forever")
+	suite.Require().NoError(err)
+	suite.Zero(ttl)
+
+	_, err = st.TTL(context.Background(), "missing")
+	suite.ErrorIs(err, storage.ErrKeyNotFound)
+}
+
+func (suite *MemoryStorageTestSuite) TestScanKeysInBatches() {
+	st := New(10, time.Minute, suite.logger)
+
+	for _, key := range []string{"clean:1", "clean:2", "clean:3", "suggest:1"} {
+		suite.Require().NoError(st.Save(context.Background(), key, "value", 0))
+	}
+
+	batches := 0
+	var keys []string
+	err := st.ScanKeys(context.Background(), "clean:*", 2, func(batch []string) error {
+		batches++
+		suite.LessOrEqual(len(batch), 2)
+		keys = append(keys, batch...)
+		return nil
+	})
+	suite.Require().NoError(err)
+	suite.Equal(2, batches)
+	suite.ElementsMatch([]string{"clean:1", "clean:2", "clean:3"}, keys)
+}
+
+func (suite *MemoryStorageTestSuite) TestSaveIfAbsent() {
+	st := New(10, 10*time.Millisecond, suite.logger)
+
+	saved, err := st.SaveIfAbsent(context.Background(), "key", "first", 0)
+	suite.Require().NoError(err)
+	suite.True(saved)
+
+	saved, err = st.SaveIfAbsent(context.Background(), "key", "second", 0)
+	suite.Require().NoError(err)
+	suite.False(saved)
+
+	value, err := st.Read(context.Background(), "key")
+	suite.Require().NoError(err)
+	suite.Equal("first", value)
+
+	time.Sleep(20 * time.Millisecond)
+
+	saved, err = st.SaveIfAbsent(context.Background(), "key", "third", 0)
+	suite.Require().NoError(err)
+	suite.True(saved, "an expired key is absent")
+}
+
+func (suite *MemoryStorageTestSuite) TestCompareAndSwap() {
+	st := New(10, time.Minute, suite.logger)
+
+	swapped, err := st.CompareAndSwap(context.Background(), "key", "", "value", 0)
+	suite.Require().NoError(err)
+	suite.False(swapped, "a missing key is not swapped")
+
+	suite.Require().NoError(st.Save(context.Background(), "key", "first", 0))
+
+	swapped, err = st.CompareAndSwap(context.Background(), "key", "other", "second", 0)
+	suite.Require().NoError(err)
+	suite.False(swapped)
+
+	swapped, err = st.CompareAndSwap(context.Background(), "key", "first", "second", 0)
+	suite.Require().NoError(err)
+	suite.True(swapped)
+
+	value, err := st.Read(context.Background(), "key")
+	suite.Require().NoError(err)
+	suite.Equal("second", value)
+}
+
+func (suite *MemoryStorageTestSuite) scanAll(st *Storage, match string) []string {
+	var keys []string
+	err := st.ScanKeys(context.Background(), match, 100, func(batch []string) error {
+		keys = append(keys, batch...)
+		return nil
+	})
+	suite.Require().NoError(err)
+
+	return keys
+}
+
+func TestMemoryStorageTestSuite(t *testing.T) {
+	t.Parallel()
+	suite.Run(t, new(MemoryStorageTestSuite))
+}
@@ -2,21 +2,37 @@ package redis
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"time"
 
 	"github.com/redis/go-redis/v9"
+
+	"github.com/ilazutin/dadataproxy_go/internal/storage"
 )
 
+// compareAndSwap sets KEYS[1] to ARGV[2] with ARGV[3] milliseconds to
+// live while it holds ARGV[1].
+var compareAndSwap = redis.NewScript(`
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+if tonumber(ARGV[3]) > 0 then
+	redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+else
+	redis.call("SET", KEYS[1], ARGV[2])
+end
+return 1
+`)
+
 type Storage struct {
-	context    context.Context
 	client     *redis.Client
 	expiration time.Duration
 	logger     *slog.Logger
 }
 
-func New(ctx context.Context, address string, password string, logger *slog.Logger, expiration time.Duration) Storage {
+func New(address string, password string, logger *slog.Logger, expiration time.Duration) Storage {
 	client := redis.NewClient(&redis.Options{
 		Addr:     address,
 		Password: password,
@@ -24,15 +40,18 @@ func New(ctx context.Context, address string, password string, logger *slog.Logg
 	})
 
 	return Storage{
-		context:    ctx,
 		client:     client,
 		expiration: expiration,
 		logger:     logger,
 	}
 }
 
-func (s Storage) Save(key string, value interface{}) error {
-	err := s.client.Set(s.context, key, value, s.expiration).Err()
+func (s Storage) Save(ctx context.Context, key string, value interface{}, expiration time.Duration) error {
+	if expiration <= 0 {
+		expiration = s.expiration
+	}
+
+	err := s.client.Set(ctx, key, value, expiration).Err()
 	if err != nil {
 		s.logger.Error(fmt.Sprintf("redis error: %s", err))
 	}
@@ -40,8 +59,38 @@ func (s Storage) Save(key string, value interface{}) error {
 	return err
 }
 
-func (s Storage) Read(key string) (interface{}, error) {
-	val, err := s.client.Get(s.context, key).Result()
+func (s Storage) SaveIfAbsent(ctx context.Context, key string, value interface{}, expiration time.Duration) (bool, error) {
+	if expiration <= 0 {
+		expiration = s.expiration
+	}
+
+	saved, err := s.client.SetNX(ctx, key, value, expiration).Result()
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("redis error: %s", err))
+	}
+
+	return saved, err
+}
+
+func (s Storage) CompareAndSwap(ctx context.Context, key string, old string, value interface{}, expiration time.Duration) (bool, error) {
+	if expiration <= 0 {
+		expiration = s.expiration
+	}
+
+	swapped, err := compareAndSwap.Run(ctx, s.client, []string{key}, old, value, expiration.Milliseconds()).Int()
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("redis error: %s", err))
+		return false, err
+	}
+
+	return swapped == 1, nil
+}
+
+func (s Storage) Read(ctx context.Context, key string) (interface{}, error) {
+	val, err := s.client.Get(ctx, key).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, storage.ErrKeyNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -49,8 +98,54 @@ func (s Storage) Read(key string) (interface{}, error) {
 	return val, nil
 }
 
-func (s Storage) ReadAllKeys() ([]string, error) {
-	rkeys := s.client.Keys(s.context, "*")
+// TTL reads PTTL, which answers -2 for a missing key and -1 for a key
+// without expiration.
+func (s Storage) TTL(ctx context.Context, key string) (time.Duration, error) {
+	ttl, err := s.client.PTTL(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	switch {
+	case ttl == -2:
+		return 0, storage.ErrKeyNotFound
+	case ttl < 0:
+		return 0, nil
+	}
+
+	return ttl, nil
+}
+
+func (s Storage) ScanKeys(ctx context.Context, match string, count int64, fn func([]string) error) error {
+	var cursor uint64
+	for {
+		keys, next, err := s.client.Scan(ctx, cursor, match, count).Result()
+		if err != nil {
+			return err
+		}
+
+		if len(keys) > 0 {
+			if err := fn(keys); err != nil {
+				return err
+			}
+		}
+
+		cursor = next
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+func (s Storage) Delete(ctx context.Context, keys ...string) (int64, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	deleted, err := s.client.Del(ctx, keys...).Result()
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("redis error: %s", err))
+	}
 
-	return rkeys.Result()
+	return deleted, err
 }
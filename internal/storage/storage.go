@@ -1,13 +1,37 @@
 package storage
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"time"
+)
 
 type Storage interface {
-	Save(string, interface{}) error
-	Read(string) (interface{}, error)
-	ReadAllKeys() ([]string, error)
+	Save(context.Context, string, interface{}, time.Duration) error
+	Read(context.Context, string) (interface{}, error)
+	ScanKeys(ctx context.Context, match string, count int64, fn func([]string) error) error
+	Delete(ctx context.Context, keys ...string) (int64, error)
+	// SaveIfAbsent saves the value unless the key exists and reports
+	// whether it was saved.
+	SaveIfAbsent(ctx context.Context, key string, value interface{}, expiration time.Duration) (bool, error)
+	// CompareAndSwap saves the value only while the key holds old and
+	// reports whether it was saved.
+	CompareAndSwap(ctx context.Context, key string, old string, value interface{}, expiration time.Duration) (bool, error)
+	// TTL returns the remaining time to live of the key, zero when it
+	// never expires, or ErrKeyNotFound.
+	TTL(ctx context.Context, key string) (time.Duration, error)
+}
+
+type TierStats struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+}
+
+type StatsReporter interface {
+	Stats() map[string]TierStats
 }
 
 var (
 	ErrUrlNotFound = errors.New("url not found")
+	ErrKeyNotFound = errors.New("key not found")
 )
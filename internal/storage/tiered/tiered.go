@@ -0,0 +1,156 @@
+package tiered
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ilazutin/dadataproxy_go/internal/storage"
+)
+
+const (
+	tierL1 = "l1"
+	tierL2 = "l2"
+)
+
+type counters struct {
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+type Storage struct {
+	l1           storage.Storage
+	l2           storage.Storage
+	l1Expiration time.Duration
+	l2Only       []string
+	l1Stat       counters
+	l2Stat       counters
+	logger       *slog.Logger
+}
+
+// New returns a storage keeping a copy of l2 in l1. The keys starting
+// with one of l2Only are read and written on l2 only, as other instances
+// change them and a stale l1 copy must not be served.
+func New(l1 storage.Storage, l2 storage.Storage, l1Expiration time.Duration, l2Only []string, logger *slog.Logger) *Storage {
+	return &Storage{
+		l1:           l1,
+		l2:           l2,
+		l1Expiration: l1Expiration,
+		l2Only:       l2Only,
+		logger:       logger,
+	}
+}
+
+func (s *Storage) Save(ctx context.Context, key string, value interface{}, expiration time.Duration) error {
+	err := s.l2.Save(ctx, key, value, expiration)
+	if err != nil || s.isL2Only(key) {
+		return err
+	}
+
+	return s.l1.Save(ctx, key, value, s.l1ExpirationFor(expiration))
+}
+
+// SaveIfAbsent and CompareAndSwap decide on l2, which is shared by the
+// instances; l1 only keeps a copy of the result.
+func (s *Storage) SaveIfAbsent(ctx context.Context, key string, value interface{}, expiration time.Duration) (bool, error) {
+	saved, err := s.l2.SaveIfAbsent(ctx, key, value, expiration)
+	if err != nil || !saved || s.isL2Only(key) {
+		return saved, err
+	}
+
+	return true, s.l1.Save(ctx, key, value, s.l1ExpirationFor(expiration))
+}
+
+// CompareAndSwap drops the l1 copy when the swap fails, as it is likely
+// stale, so the next read gets the current value from l2.
+func (s *Storage) CompareAndSwap(ctx context.Context, key string, old string, value interface{}, expiration time.Duration) (bool, error) {
+	swapped, err := s.l2.CompareAndSwap(ctx, key, old, value, expiration)
+	if err != nil || s.isL2Only(key) {
+		return swapped, err
+	}
+
+	if !swapped {
+		if _, err := s.l1.Delete(ctx, key); err != nil {
+			s.logger.Warn("Cannot delete from l1 cache", slog.String("error", err.Error()))
+		}
+		return false, nil
+	}
+
+	return true, s.l1.Save(ctx, key, value, s.l1ExpirationFor(expiration))
+}
+
+func (s *Storage) Read(ctx context.Context, key string) (interface{}, error) {
+	if s.isL2Only(key) {
+		return s.l2.Read(ctx, key)
+	}
+
+	value, err := s.l1.Read(ctx, key)
+	if err == nil && value != nil {
+		s.l1Stat.hits.Add(1)
+		return value, nil
+	}
+	s.l1Stat.misses.Add(1)
+
+	value, err = s.l2.Read(ctx, key)
+	if err != nil || value == nil {
+		s.l2Stat.misses.Add(1)
+		return value, err
+	}
+	s.l2Stat.hits.Add(1)
+
+	if err := s.l1.Save(ctx, key, value, s.l1Expiration); err != nil {
+		s.logger.Warn("Cannot fill l1 cache", slog.String("key", key), slog.String("error", err.Error()))
+	}
+
+	return value, nil
+}
+
+// TTL is read from l2, as l1 copies expire earlier.
+func (s *Storage) TTL(ctx context.Context, key string) (time.Duration, error) {
+	return s.l2.TTL(ctx, key)
+}
+
+func (s *Storage) ScanKeys(ctx context.Context, match string, count int64, fn func([]string) error) error {
+	return s.l2.ScanKeys(ctx, match, count, fn)
+}
+
+func (s *Storage) Delete(ctx context.Context, keys ...string) (int64, error) {
+	deleted, err := s.l2.Delete(ctx, keys...)
+	if err != nil {
+		return deleted, err
+	}
+
+	if _, err := s.l1.Delete(ctx, keys...); err != nil {
+		s.logger.Warn("Cannot delete from l1 cache", slog.String("error", err.Error()))
+	}
+
+	return deleted, nil
+}
+
+func (s *Storage) isL2Only(key string) bool {
+	for _, prefix := range s.l2Only {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// l1ExpirationFor caps the l1 expiration by the expiration of the key.
+func (s *Storage) l1ExpirationFor(expiration time.Duration) time.Duration {
+	if expiration > 0 && expiration < s.l1Expiration {
+		return expiration
+	}
+
+	return s.l1Expiration
+}
+
+func (s *Storage) Stats() map[string]storage.TierStats {
+	return map[string]storage.TierStats{
+		tierL1: {Hits: s.l1Stat.hits.Load(), Misses: s.l1Stat.misses.Load()},
+		tierL2: {Hits: s.l2Stat.hits.Load(), Misses: s.l2Stat.misses.Load()},
+	}
+}
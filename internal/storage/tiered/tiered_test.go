@@ -0,0 +1,112 @@
+package tiered
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/ilazutin/dadataproxy_go/internal/storage"
+	"github.com/ilazutin/dadataproxy_go/internal/storage/memory"
+)
+
+type TieredStorageTestSuite struct {
+	suite.Suite
+
+	l1      *memory.Storage
+	l2      *memory.Storage
+	storage *Storage
+}
+
+func (suite *TieredStorageTestSuite) SetupTest() {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	suite.l1 = memory.New(10, time.Minute, logger)
+	suite.l2 = memory.New(10, time.Hour, logger)
+	suite.storage = New(suite.l1, suite.l2, time.Minute, []string{"app:jobs:"}, logger)
+}
+
+func (suite *TieredStorageTestSuite) TestFillsL1OnL2Hit() {
+	suite.Require().NoError(suite.l2.Save(context.Background(), "key", "value", 0))
+
+	value, err := suite.storage.Read(context.Background(), "key")
+	suite.Require().NoError(err)
+	suite.Equal("value", value)
+
+	value, err = suite.l1.Read(context.Background(), "key")
+	suite.Require().NoError(err)
+	suite.Equal("value", value)
+
+	_, err = suite.storage.Read(context.Background(), "key")
+	suite.Require().NoError(err)
+
+	_, err = suite.storage.Read(context.Background(), "missing")
+	suite.ErrorIs(err, storage.ErrKeyNotFound)
+
+	suite.Equal(map[string]storage.TierStats{
+		tierL1: {Hits: 1, Misses: 2},
+		tierL2: {Hits: 1, Misses: 1},
+	}, suite.storage.Stats())
+}
+
+func (suite *TieredStorageTestSuite) TestL1ExpirationIsCapped() {
+	suite.Require().NoError(suite.storage.Save(context.Background(), "short", "value", 10*time.Millisecond))
+	suite.Require().NoError(suite.storage.Save(context.Background(), "long", "value", 24*time.Hour))
+
+	time.Sleep(20 * time.Millisecond)
+
+	_, err := suite.l1.Read(context.Background(), "short")
+	suite.ErrorIs(err, storage.ErrKeyNotFound)
+
+	_, err = suite.l1.Read(context.Background(), "long")
+	suite.NoError(err)
+}
+
+func (suite *TieredStorageTestSuite) TestCompareAndSwapDropsStaleL1() {
+	suite.Require().NoError(suite.storage.Save(context.Background(), "key", "first", 0))
+	suite.Require().NoError(suite.l2.Save(context.Background(), "key", "second", 0))
+
+	swapped, err := suite.storage.CompareAndSwap(context.Background(), "key", "first", "third", 0)
+	suite.Require().NoError(err)
+	suite.False(swapped)
+
+	value, err := suite.storage.Read(context.Background(), "key")
+	suite.Require().NoError(err)
+	suite.Equal("second", value)
+
+	swapped, err = suite.storage.CompareAndSwap(context.Background(), "key", "second", "third", 0)
+	suite.Require().NoError(err)
+	suite.True(swapped)
+
+	value, err = suite.l1.Read(context.Background(), "key")
+	suite.Require().NoError(err)
+	suite.Equal("third", value)
+}
+
+func (suite *TieredStorageTestSuite) TestL2OnlyKeysSkipL1() {
+	suite.Require().NoError(suite.storage.Save(context.Background(), "app:jobs:1", "pending", 0))
+	saved, err := suite.storage.SaveIfAbsent(context.Background(), "app:jobs:2", "pending", 0)
+	suite.Require().NoError(err)
+	suite.True(saved)
+
+	swapped, err := suite.storage.CompareAndSwap(context.Background(), "app:jobs:1", "pending", "running", 0)
+	suite.Require().NoError(err)
+	suite.True(swapped)
+
+	for _, key := range []string{"app:jobs:1", "app:jobs:2"} {
+		_, err = suite.l1.Read(context.Background(), key)
+		suite.ErrorIs(err, storage.ErrKeyNotFound)
+	}
+
+	suite.Require().NoError(suite.l1.Save(context.Background(), "app:jobs:1", "stale", 0))
+	value, err := suite.storage.Read(context.Background(), "app:jobs:1")
+	suite.Require().NoError(err)
+	suite.Equal("running", value)
+}
+
+func TestTieredStorageTestSuite(t *testing.T) {
+	t.Parallel()
+	suite.Run(t, new(TieredStorageTestSuite))
+}